@@ -49,9 +49,18 @@ type TaskResourceUsage struct {
 type AllocResourceUsage struct {
 	ResourceUsage *ResourceUsage
 	Tasks         map[string]*TaskResourceUsage
+	DiskUsage     *DiskUsage
 	Timestamp     int64
 }
 
+// DiskUsage holds the measured disk usage of an allocation directory
+type DiskUsage struct {
+	UsedBytes uint64
+	LimitMB   int
+	Exceeded  bool
+	Timestamp int64
+}
+
 // RestartPolicy defines how the Nomad client restarts
 // tasks in a taskgroup when they fail
 type RestartPolicy struct {
@@ -249,22 +258,23 @@ type DispatchPayloadConfig struct {
 
 // Task is a single process in a task group.
 type Task struct {
-	Name            string
-	Driver          string
-	User            string
-	Config          map[string]interface{}
-	Constraints     []*Constraint
-	Env             map[string]string
-	Services        []*Service
-	Resources       *Resources
-	Meta            map[string]string
-	KillTimeout     *time.Duration `mapstructure:"kill_timeout"`
-	LogConfig       *LogConfig     `mapstructure:"logs"`
-	Artifacts       []*TaskArtifact
-	Vault           *Vault
-	Templates       []*Template
-	DispatchPayload *DispatchPayloadConfig
-	Leader          bool
+	Name             string
+	Driver           string
+	User             string
+	Config           map[string]interface{}
+	Constraints      []*Constraint
+	Env              map[string]string
+	Services         []*Service
+	Resources        *Resources
+	Meta             map[string]string
+	KillTimeout      *time.Duration `mapstructure:"kill_timeout"`
+	LogConfig        *LogConfig     `mapstructure:"logs"`
+	SecretsDirSizeMB int            `mapstructure:"secrets_dir_size"`
+	Artifacts        []*TaskArtifact
+	Vault            *Vault
+	Templates        []*Template
+	DispatchPayload  *DispatchPayloadConfig
+	Leader           bool
 }
 
 func (t *Task) Canonicalize(tg *TaskGroup, job *Job) {
@@ -450,6 +460,7 @@ const (
 	TaskSignaling              = "Signaling"
 	TaskRestartSignal          = "Restart Signaled"
 	TaskLeaderDead             = "Leader Task Dead"
+	TaskDiskExceeded           = "Disk Resources Exceeded"
 )
 
 // TaskEvent is an event that effects the state of a task and contains meta-data
@@ -48,8 +48,13 @@ type AllocRunner struct {
 	dirtyCh chan struct{}
 
 	allocDir     *allocdir.AllocDir
+	diskWatcher  *allocdir.DiskWatcher
 	allocDirLock sync.Mutex
 
+	// diskExceededCh is sent to when the alloc dir exceeds its disk limit and
+	// the limit is enforced
+	diskExceededCh chan *cstructs.DiskUsage
+
 	tasks      map[string]*TaskRunner
 	taskStates map[string]*structs.TaskState
 	restored   map[string]struct{}
@@ -98,18 +103,19 @@ type allocRunnerState struct {
 func NewAllocRunner(logger *log.Logger, config *config.Config, updater AllocStateUpdater,
 	alloc *structs.Allocation, vaultClient vaultclient.VaultClient) *AllocRunner {
 	ar := &AllocRunner{
-		config:      config,
-		updater:     updater,
-		logger:      logger,
-		alloc:       alloc,
-		dirtyCh:     make(chan struct{}, 1),
-		tasks:       make(map[string]*TaskRunner),
-		taskStates:  copyTaskStates(alloc.TaskStates),
-		restored:    make(map[string]struct{}),
-		updateCh:    make(chan *structs.Allocation, 64),
-		destroyCh:   make(chan struct{}),
-		waitCh:      make(chan struct{}),
-		vaultClient: vaultClient,
+		config:         config,
+		updater:        updater,
+		logger:         logger,
+		alloc:          alloc,
+		dirtyCh:        make(chan struct{}, 1),
+		diskExceededCh: make(chan *cstructs.DiskUsage, 1),
+		tasks:          make(map[string]*TaskRunner),
+		taskStates:     copyTaskStates(alloc.TaskStates),
+		restored:       make(map[string]struct{}),
+		updateCh:       make(chan *structs.Allocation, 64),
+		destroyCh:      make(chan struct{}),
+		waitCh:         make(chan struct{}),
+		vaultClient:    vaultClient,
 	}
 	return ar
 }
@@ -159,6 +165,19 @@ func (r *AllocRunner) RestoreState() error {
 
 	r.taskStates = snap.Alloc.TaskStates
 
+	// Remount the image backing the alloc dir, for example after a reboot,
+	// before the restored tasks write to it
+	if err := r.allocDir.RemountImage(); err != nil {
+		r.logger.Printf("[ERR] client: failed to remount image for alloc %q: %v", r.alloc.ID, err)
+		return err
+	}
+
+	// A snapshot archive left by the previous run can't be resumed or expired
+	// as neither its checksum nor its expiry were persisted
+	if err := r.allocDir.RemoveSnapshotArchive(); err != nil {
+		r.logger.Printf("[WARN] client: failed to remove snapshot archive for alloc %q: %v", r.alloc.ID, err)
+	}
+
 	// Restore the task runners
 	var mErr multierror.Error
 	for name, state := range r.taskStates {
@@ -472,6 +491,18 @@ func (r *AllocRunner) Run() {
 	if r.allocDir == nil {
 		// Build allocation directory
 		r.allocDir = allocdir.NewAllocDir(r.logger, filepath.Join(r.config.AllocDir, r.alloc.ID))
+		r.allocDir.SELinuxLabel = r.config.ReadDefault("alloc_dir.selinux.label", "")
+
+		// Back the alloc dir with an image sized to the group's ephemeral disk
+		if r.config.ReadBoolDefault("alloc_dir.image.enable", false) && tg.EphemeralDisk != nil {
+			if err := r.allocDir.MountImage(tg.EphemeralDisk.SizeMB); err != nil {
+				r.logger.Printf("[ERR] client: failed to mount image for alloc %q: %v", r.alloc.ID, err)
+				r.setStatus(structs.AllocClientStatusFailed, fmt.Sprintf("failed to mount alloc dir image for '%s'", alloc.TaskGroup))
+				r.allocDirLock.Unlock()
+				return
+			}
+		}
+
 		if err := r.allocDir.Build(); err != nil {
 			r.logger.Printf("[WARN] client: failed to build task directories: %v", err)
 			r.setStatus(structs.AllocClientStatusFailed, fmt.Sprintf("failed to build task dirs for '%s'", alloc.TaskGroup))
@@ -487,6 +518,18 @@ func (r *AllocRunner) Run() {
 				r.logger.Printf("[ERROR] client: error destroying allocdir %v: %v", r.otherAllocDir.AllocDir, err)
 			}
 		}
+
+		// Limit the alloc dir to the group's ephemeral disk
+		if r.config.ReadBoolDefault("alloc_dir.quota.enable", false) && tg.EphemeralDisk != nil {
+			if err := r.allocDir.SetQuota(tg.EphemeralDisk.SizeMB); err == allocdir.ErrQuotaUnsupported {
+				r.logger.Printf("[WARN] client: not enforcing disk quota for alloc %q: %v", r.alloc.ID, err)
+			} else if err != nil {
+				r.logger.Printf("[ERR] client: failed to set disk quota for alloc %q: %v", r.alloc.ID, err)
+				r.setStatus(structs.AllocClientStatusFailed, fmt.Sprintf("failed to set disk quota for '%s'", alloc.TaskGroup))
+				r.allocDirLock.Unlock()
+				return
+			}
+		}
 	}
 	r.allocDirLock.Unlock()
 
@@ -500,6 +543,18 @@ func (r *AllocRunner) Run() {
 		return
 	}
 
+	// Start tracking the disk usage of the alloc dir
+	if interval := r.config.ReadDurationDefault("alloc_dir.disk_usage.interval", 0); interval > 0 {
+		limit := 0
+		if tg.EphemeralDisk != nil {
+			limit = tg.EphemeralDisk.SizeMB
+		}
+		r.allocDirLock.Lock()
+		r.diskWatcher = allocdir.NewDiskWatcher(r.logger, r.allocDir, interval, limit, r.handleDiskExceeded)
+		r.allocDirLock.Unlock()
+		go r.diskWatcher.Run()
+	}
+
 	// Start the task runners
 	r.logger.Printf("[DEBUG] client: starting task runners for alloc '%s'", r.alloc.ID)
 	r.taskLock.Lock()
@@ -548,9 +603,21 @@ OUTER:
 		case <-r.destroyCh:
 			taskDestroyEvent = structs.NewTaskEvent(structs.TaskKilled)
 			break OUTER
+		case usage := <-r.diskExceededCh:
+			r.logger.Printf("[WARN] client: alloc %q exceeded its disk limit of %d MB, killing tasks", r.alloc.ID, usage.LimitMB)
+			taskDestroyEvent = structs.NewTaskEvent(structs.TaskDiskExceeded).
+				SetDiskLimit(int64(usage.LimitMB) * 1024 * 1024).SetFailsTask()
+			break OUTER
 		}
 	}
 
+	// Stop tracking the disk usage
+	r.allocDirLock.Lock()
+	if r.diskWatcher != nil {
+		r.diskWatcher.Shutdown()
+	}
+	r.allocDirLock.Unlock()
+
 	// Kill the task runners
 	r.destroyTaskRunners(taskDestroyEvent)
 
@@ -559,6 +626,32 @@ OUTER:
 	r.logger.Printf("[DEBUG] client: terminating runner for alloc '%s'", r.alloc.ID)
 }
 
+// handleDiskExceeded is called by the disk watcher when the alloc dir exceeds
+// its disk limit. If the limit is enforced the tasks are killed, otherwise an
+// event is recorded on each task.
+func (r *AllocRunner) handleDiskExceeded(usage *cstructs.DiskUsage) {
+	if r.config.ReadBoolDefault("alloc_dir.disk_usage.enforce", false) {
+		select {
+		case r.diskExceededCh <- usage:
+		default:
+		}
+		return
+	}
+
+	r.logger.Printf("[WARN] client: alloc %q is using %d bytes exceeding its disk limit of %d MB",
+		r.alloc.ID, usage.UsedBytes, usage.LimitMB)
+	for _, tr := range r.getTaskRunners() {
+		event := structs.NewTaskEvent(structs.TaskDiskExceeded).SetDiskLimit(int64(usage.LimitMB) * 1024 * 1024)
+		r.setTaskState(tr.task.Name, "", event)
+	}
+
+	// Events appended without a state change aren't synced on their own
+	select {
+	case r.dirtyCh <- struct{}{}:
+	default:
+	}
+}
+
 // SetPreviousAllocDir sets the previous allocation directory of the current
 // allocation
 func (r *AllocRunner) SetPreviousAllocDir(allocDir *allocdir.AllocDir) {
@@ -670,6 +763,12 @@ func (r *AllocRunner) LatestAllocStats(taskFilter string) (*cstructs.AllocResour
 	}
 
 	astat.ResourceUsage = sumTaskResourceUsage(flat)
+
+	r.allocDirLock.Lock()
+	if r.diskWatcher != nil {
+		astat.DiskUsage = r.diskWatcher.LatestUsage()
+	}
+	r.allocDirLock.Unlock()
 	return astat, nil
 }
 
@@ -2,12 +2,20 @@ package allocdir
 
 import (
 	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"gopkg.in/tomb.v1"
@@ -17,7 +25,17 @@ import (
 	"github.com/hpcloud/tail/watch"
 )
 
+const (
+	// snapshotArchiveTTL is how long the archive created by SnapshotArchive
+	// is kept after it was last requested so an interrupted transfer of it
+	// can be resumed.
+	snapshotArchiveTTL = 5 * time.Minute
+)
+
 var (
+	// ErrRestoreStopped is returned by Restore if it was stopped.
+	ErrRestoreStopped = errors.New("restoring snapshot stopped")
+
 	// The name of the directory that is shared across tasks in a task group.
 	SharedAllocName = "alloc"
 
@@ -55,6 +73,17 @@ type AllocDir struct {
 	// TaskDirs is a mapping of task names to their non-shared directory.
 	TaskDirs map[string]*TaskDir
 
+	// SELinuxLabel is the SELinux context the alloc dir and its task dirs
+	// are labeled with on hosts with SELinux enabled. If empty the dirs
+	// aren't labeled.
+	SELinuxLabel string
+
+	// snapshotSum is the checksum of the archive returned by SnapshotArchive
+	// and snapshotTimer removes the archive once it expires.
+	snapshotSum   string
+	snapshotTimer *time.Timer
+	snapshotLock  sync.Mutex
+
 	logger *log.Logger
 }
 
@@ -73,6 +102,8 @@ type AllocDirFS interface {
 	Stat(path string) (*AllocFileInfo, error)
 	ReadAt(path string, offset int64) (io.ReadCloser, error)
 	Snapshot(w io.Writer) error
+	SnapshotArchive(refresh bool) (*os.File, string, error)
+	ReleaseSnapshotArchive(checksum string) error
 	BlockUntilExists(path string, t *tomb.Tomb) (chan error, error)
 	ChangeEvents(path string, curOffset int64, t *tomb.Tomb) (*watch.FileChanges, error)
 }
@@ -91,12 +122,14 @@ func NewAllocDir(logger *log.Logger, allocDir string) *AllocDir {
 // NewTaskDir creates a new TaskDir and adds it to the AllocDirs TaskDirs map.
 func (d *AllocDir) NewTaskDir(name string) *TaskDir {
 	td := newTaskDir(d.logger, d.AllocDir, name)
+	td.SELinuxLabel = d.SELinuxLabel
 	d.TaskDirs[name] = td
 	return td
 }
 
-// Snapshot creates an archive of the files and directories in the data dir of
-// the allocation and the task local directories
+// Snapshot creates a tar archive of the files and directories in the data dir
+// of the allocation and the task local directories. Symlinks and anything
+// mounted beneath those directories are skipped.
 func (d *AllocDir) Snapshot(w io.Writer) error {
 	allocDataDir := filepath.Join(d.SharedDir, SharedDataDir)
 	rootPaths := []string{allocDataDir}
@@ -105,11 +138,25 @@ func (d *AllocDir) Snapshot(w io.Writer) error {
 	}
 
 	tw := tar.NewWriter(w)
-	defer tw.Close()
+
+	// rootDev is the device of the root path being walked
+	var rootDev uint64
 
 	walkFn := func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
 		// Ignore if the file is a symlink
-		if fileInfo.Mode() == os.ModeSymlink {
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		// Skip anything mounted into the directory
+		if dev, ok := fileDevice(fileInfo); ok && dev != rootDev {
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
@@ -123,8 +170,10 @@ func (d *AllocDir) Snapshot(w io.Writer) error {
 		if err != nil {
 			return fmt.Errorf("error creating file header: %v", err)
 		}
-		hdr.Name = relPath
-		tw.WriteHeader(hdr)
+		hdr.Name = filepath.ToSlash(relPath)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
 
 		// If it's a directory we just write the header into the tar
 		if fileInfo.IsDir() {
@@ -147,14 +196,278 @@ func (d *AllocDir) Snapshot(w io.Writer) error {
 	// Walk through all the top level directories and add the files and
 	// directories in the archive
 	for _, path := range rootPaths {
+		fileInfo, err := os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		rootDev, _ = fileDevice(fileInfo)
+
 		if err := filepath.Walk(path, walkFn); err != nil {
 			return err
 		}
 	}
 
+	return tw.Close()
+}
+
+// Restore extracts an archive created by Snapshot, or a gzipped one created by
+// SnapshotArchive, into the alloc dir. The alloc dir should be restored before
+// it is built or moved. If stopCh is closed restoring stops and
+// ErrRestoreStopped is returned.
+func (d *AllocDir) Restore(r io.Reader, stopCh <-chan struct{}) error {
+	tr, err := NewSnapshotReader(&stopReader{r: r, stopCh: stopCh})
+	if err != nil {
+		select {
+		case <-stopCh:
+			return ErrRestoreStopped
+		default:
+		}
+		return err
+	}
+
+	for {
+		select {
+		case <-stopCh:
+			return ErrRestoreStopped
+		default:
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == ErrRestoreStopped {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("error reading snapshot: %v", err)
+		}
+
+		path, err := d.snapshotPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, os.FileMode(hdr.Mode)); err != nil {
+				return fmt.Errorf("error creating dir %q: %v", hdr.Name, err)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := restoreFile(path, hdr, tr); err != nil {
+				return err
+			}
+		default:
+			// Snapshot only archives directories and regular files
+			continue
+		}
+	}
+}
+
+// snapshotPath returns the path within the alloc dir of an archived file. An
+// error is returned if the name would escape the alloc dir.
+func (d *AllocDir) snapshotPath(name string) (string, error) {
+	path := filepath.Join(d.AllocDir, filepath.FromSlash(name))
+	if path != d.AllocDir && !strings.HasPrefix(path, d.AllocDir+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path in snapshot: %q", name)
+	}
+	return path, nil
+}
+
+// restoreFile writes an archived regular file to path with the archived mode
+// and ownership.
+func restoreFile(path string, hdr *tar.Header, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return fmt.Errorf("error creating dir for %q: %v", hdr.Name, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+	if err != nil {
+		return fmt.Errorf("error creating file %q: %v", hdr.Name, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err == ErrRestoreStopped {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("error writing file %q: %v", hdr.Name, err)
+	}
+
+	// Setting the permissions of the file as the origin.
+	if err := f.Chmod(os.FileMode(hdr.Mode)); err != nil {
+		return fmt.Errorf("error chmoding file %q: %v", hdr.Name, err)
+	}
+	if err := f.Chown(hdr.Uid, hdr.Gid); err != nil {
+		return fmt.Errorf("error chowning file %q: %v", hdr.Name, err)
+	}
+	return nil
+}
+
+// stopReader reads from r until stopCh is closed, after which reads fail with
+// ErrRestoreStopped.
+type stopReader struct {
+	r      io.Reader
+	stopCh <-chan struct{}
+}
+
+func (s *stopReader) Read(p []byte) (int, error) {
+	select {
+	case <-s.stopCh:
+		return 0, ErrRestoreStopped
+	default:
+	}
+	return s.r.Read(p)
+}
+
+// SnapshotArchive opens a gzipped archive of the alloc dir as created by
+// Snapshot along with the hex encoded SHA-256 checksum of its contents. The
+// archive is created if refresh is set or none exists, otherwise the previous
+// archive is returned so an interrupted transfer of it can be resumed. The
+// archive should be released once it has been transferred. Archives that
+// aren't requested again within snapshotArchiveTTL are removed.
+func (d *AllocDir) SnapshotArchive(refresh bool) (*os.File, string, error) {
+	d.snapshotLock.Lock()
+	defer d.snapshotLock.Unlock()
+
+	path := d.archivePath()
+	if !refresh {
+		f, err := os.Open(path)
+		if err == nil {
+			if d.snapshotSum != "" {
+				d.expireArchive()
+				return f, d.snapshotSum, nil
+			}
+
+			// The checksum is lost when the client restarts
+			h := sha256.New()
+			if _, err := io.Copy(h, f); err != nil {
+				f.Close()
+				return nil, "", err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				f.Close()
+				return nil, "", err
+			}
+			d.snapshotSum = hex.EncodeToString(h.Sum(nil))
+			d.expireArchive()
+			return f, d.snapshotSum, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, "", err
+		}
+	}
+
+	// Write the archive to a temporary file and rename it into place so
+	// archives already opened aren't modified.
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating snapshot archive: %v", err)
+	}
+	h := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(f, h))
+	if err := d.Snapshot(gz); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", fmt.Errorf("error creating snapshot archive: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, "", err
+	}
+
+	d.snapshotSum = hex.EncodeToString(h.Sum(nil))
+	d.expireArchive()
+	return f, d.snapshotSum, nil
+}
+
+// ReleaseSnapshotArchive removes the archive created by SnapshotArchive if it
+// still has the given checksum. Archives already opened remain readable.
+func (d *AllocDir) ReleaseSnapshotArchive(checksum string) error {
+	d.snapshotLock.Lock()
+	defer d.snapshotLock.Unlock()
+
+	if checksum != d.snapshotSum {
+		return nil
+	}
+	return d.removeArchive()
+}
+
+// RemoveSnapshotArchive removes the archive created by SnapshotArchive. It
+// should be called when restoring an allocation as the checksum and expiry of
+// an archive left by a previous run of the client aren't persisted.
+func (d *AllocDir) RemoveSnapshotArchive() error {
+	d.snapshotLock.Lock()
+	defer d.snapshotLock.Unlock()
+	return d.removeArchive()
+}
+
+// expireArchive schedules the archive to be removed after
+// snapshotArchiveTTL, replacing any previous schedule. snapshotLock must be
+// held.
+func (d *AllocDir) expireArchive() {
+	if d.snapshotTimer != nil {
+		d.snapshotTimer.Stop()
+	}
+	checksum := d.snapshotSum
+	d.snapshotTimer = time.AfterFunc(snapshotArchiveTTL, func() {
+		if err := d.ReleaseSnapshotArchive(checksum); err != nil {
+			d.logger.Printf("[WARN] client: failed to remove expired snapshot archive: %v", err)
+		}
+	})
+}
+
+// removeArchive removes the archive and stops its expiry. snapshotLock must
+// be held.
+func (d *AllocDir) removeArchive() error {
+	if d.snapshotTimer != nil {
+		d.snapshotTimer.Stop()
+		d.snapshotTimer = nil
+	}
+	d.snapshotSum = ""
+	if err := os.Remove(d.archivePath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove snapshot archive: %v", err)
+	}
 	return nil
 }
 
+// archivePath returns the path of the archive created by SnapshotArchive. It
+// is kept next to the alloc dir so it isn't included in the snapshot.
+func (d *AllocDir) archivePath() string {
+	return d.AllocDir + ".snapshot"
+}
+
+// NewSnapshotReader returns a tar reader for an archive created by Snapshot or
+// SnapshotArchive. Archives which aren't gzipped are read as is.
+func NewSnapshotReader(r io.Reader) (*tar.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == io.EOF || (err == nil && (magic[0] != 0x1f || magic[1] != 0x8b)) {
+		return tar.NewReader(br), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot: %v", err)
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot: %v", err)
+	}
+	return tar.NewReader(gz), nil
+}
+
 // Move other alloc directory's shared path and local dir to this alloc dir.
 func (d *AllocDir) Move(other *AllocDir, tasks []*structs.Task) error {
 	// Move the data directory
@@ -162,7 +475,7 @@ func (d *AllocDir) Move(other *AllocDir, tasks []*structs.Task) error {
 	dataDir := filepath.Join(d.SharedDir, SharedDataDir)
 	if fileInfo, err := os.Stat(otherDataDir); fileInfo != nil && err == nil {
 		os.Remove(dataDir) // remove an empty data dir if it exists
-		if err := os.Rename(otherDataDir, dataDir); err != nil {
+		if err := moveDir(otherDataDir, dataDir); err != nil {
 			return fmt.Errorf("error moving data dir: %v", err)
 		}
 	}
@@ -181,7 +494,7 @@ func (d *AllocDir) Move(other *AllocDir, tasks []*structs.Task) error {
 			}
 			localDir := filepath.Join(newTaskDir, TaskLocal)
 			os.Remove(localDir) // remove an empty local dir if it exists
-			if err := os.Rename(otherTaskLocal, localDir); err != nil {
+			if err := moveDir(otherTaskLocal, localDir); err != nil {
 				return fmt.Errorf("error moving task %q local dir: %v", task.Name, err)
 			}
 		}
@@ -190,6 +503,72 @@ func (d *AllocDir) Move(other *AllocDir, tasks []*structs.Task) error {
 	return nil
 }
 
+// moveDir renames src to dst. If they're on different filesystems, such as
+// alloc dirs backed by separate images, src is copied to dst and removed.
+func moveDir(src, dst string) error {
+	err := os.Rename(src, dst)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+
+	if err := copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree copies the directories, regular files and symlinks in src to dst
+// preserving their modes and, where supported, ownership.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, info.Mode()); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if err := fileCopy(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, info.Mode()); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		default:
+			// Skip devices, sockets and pipes
+			return nil
+		}
+
+		if uid, gid, ok := fileOwner(info); ok {
+			if err := os.Lchown(target, uid, gid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Tears down previously build directory structure.
 func (d *AllocDir) Destroy() error {
 
@@ -199,10 +578,25 @@ func (d *AllocDir) Destroy() error {
 		mErr.Errors = append(mErr.Errors, err)
 	}
 
+	// Release the quota so its project can be reused.
+	if err := removeQuota(d.AllocDir); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+
+	// Unmount and remove the image backing the alloc dir if there is one.
+	if err := unmountImage(d.AllocDir, d.imagePath()); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+
 	if err := os.RemoveAll(d.AllocDir); err != nil {
 		mErr.Errors = append(mErr.Errors, fmt.Errorf("failed to remove alloc dir %q: %v", d.AllocDir, err))
 	}
 
+	// Remove the snapshot archive served for migrations.
+	if err := d.RemoveSnapshotArchive(); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+
 	return mErr.ErrorOrNil()
 }
 
@@ -232,6 +626,11 @@ func (d *AllocDir) UnmountAll() error {
 		if err := dir.unmountSpecialDirs(); err != nil {
 			mErr.Errors = append(mErr.Errors, err)
 		}
+
+		// Unmount the chroot overlays
+		if err := dir.unmountOverlays(); err != nil {
+			mErr.Errors = append(mErr.Errors, err)
+		}
 	}
 
 	return mErr.ErrorOrNil()
@@ -265,9 +664,125 @@ func (d *AllocDir) Build() error {
 		}
 	}
 
+	// Label the alloc dir and the shared dir which is mounted into tasks
+	if err := setLabel(d.AllocDir, d.SELinuxLabel); err != nil {
+		return fmt.Errorf("Failed to label the alloc directory: %v", err)
+	}
+	if err := relabel(d.SharedDir, d.SELinuxLabel); err != nil {
+		return fmt.Errorf("Failed to label the shared directory: %v", err)
+	}
+
 	return nil
 }
 
+// MountImage backs the allocation directory with a sparse ext4 image of
+// sizeMB mounted through a loop device. This gives the allocation a hard disk
+// limit on filesystems without quota support. It must be called before Build.
+// If the image is already mounted nothing is done.
+func (d *AllocDir) MountImage(sizeMB int) error {
+	return mountImage(d.AllocDir, d.imagePath(), sizeMB)
+}
+
+// RemountImage mounts the image backing a restored allocation directory if it
+// has one and it isn't mounted, for example after a reboot. It must be called
+// before the restored tasks use the directory.
+func (d *AllocDir) RemountImage() error {
+	return remountImage(d.AllocDir, d.imagePath())
+}
+
+// imagePath returns the path of the image backing the alloc dir. It is kept
+// next to the alloc dir since it can't be inside the mount.
+func (d *AllocDir) imagePath() string {
+	return d.AllocDir + ".img"
+}
+
+// SetQuota limits the disk usage of the allocation directory to sizeMB using
+// filesystem project quotas. The shared dir and the directories task dirs
+// write to are charged to the quota when the task dirs are built, while
+// chroots embedded in the task dirs aren't. It should be called after Build
+// and Move as files can't be moved into a directory with a different project.
+// ErrQuotaUnsupported is returned if the filesystem doesn't support project
+// quotas.
+func (d *AllocDir) SetQuota(sizeMB int) error {
+	return setQuota(d.AllocDir, []string{d.SharedDir}, sizeMB)
+}
+
+// DiskUsage returns the number of bytes used by the allocation directory.
+// Mounts within the alloc dir, such as the secrets tmpfs, special dirs and
+// chroot overlays, are skipped. Files linked more than once are counted once
+// and only if all of their links are within the alloc dir, so chroot entries
+// hardlinked from the host aren't charged to the allocation. The result
+// matches what du reports for the data actually written by the allocation.
+func (d *AllocDir) DiskUsage() (uint64, error) {
+	root, err := os.Lstat(d.AllocDir)
+	if err != nil {
+		return 0, err
+	}
+	rootDev, hasDev := fileDevice(root)
+
+	// links tracks files linked more than once by inode
+	type linkedFile struct {
+		size  uint64
+		nlink uint64
+		seen  uint64
+	}
+	links := make(map[uint64]*linkedFile)
+
+	var used uint64
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files may be removed by tasks while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		// Skip anything mounted into the alloc dir
+		if dev, ok := fileDevice(info); hasDev && ok && dev != rootDev {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip the shared alloc dir bind mounted into each task dir:
+		// <alloc_dir>/<task>/alloc
+		if info.IsDir() && info.Name() == SharedAllocName && filepath.Dir(filepath.Dir(path)) == d.AllocDir {
+			return filepath.SkipDir
+		}
+
+		size, ino, nlink, ok := diskUsage(info)
+		if !ok {
+			used += uint64(info.Size())
+			return nil
+		}
+		if nlink <= 1 || info.IsDir() {
+			used += size
+			return nil
+		}
+
+		f, ok := links[ino]
+		if !ok {
+			f = &linkedFile{size: size, nlink: nlink}
+			links[ino] = f
+		}
+		f.seen++
+		return nil
+	}
+
+	if err := filepath.Walk(d.AllocDir, walkFn); err != nil {
+		return 0, err
+	}
+
+	for _, f := range links {
+		if f.seen >= f.nlink {
+			used += f.size
+		}
+	}
+	return used, nil
+}
+
 // List returns the list of files at a path relative to the alloc dir
 func (d *AllocDir) List(path string) ([]*AllocFileInfo, error) {
 	if escapes, err := structs.PathEscapesAllocDir("", path); err != nil {
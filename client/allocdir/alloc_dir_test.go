@@ -3,6 +3,9 @@ package allocdir
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"io/ioutil"
 	"log"
@@ -198,6 +201,257 @@ func TestAllocDir_Snapshot(t *testing.T) {
 	}
 }
 
+func TestAllocDir_SnapshotArchive(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), filepath.Join(tmp, "alloc"))
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	dataFile := filepath.Join(d.SharedDir, SharedDataDir, "bar")
+	if err := ioutil.WriteFile(dataFile, []byte("foo"), 0666); err != nil {
+		t.Fatalf("Couldn't write file to shared directory: %v", err)
+	}
+
+	f, sum1, err := d.SnapshotArchive(true)
+	if err != nil {
+		t.Fatalf("SnapshotArchive() failed: %v", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f.Close()
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != sum1 {
+		t.Fatalf("checksum %q doesn't match contents %q", sum1, actual)
+	}
+
+	// Changes aren't included unless the archive is refreshed
+	if err := ioutil.WriteFile(dataFile, []byte("foobar"), 0666); err != nil {
+		t.Fatalf("Couldn't write file to shared directory: %v", err)
+	}
+	f, sum2, err := d.SnapshotArchive(false)
+	if err != nil {
+		t.Fatalf("SnapshotArchive() failed: %v", err)
+	}
+	f.Close()
+	if sum1 != sum2 {
+		t.Fatalf("expected archive to be reused")
+	}
+
+	f, sum3, err := d.SnapshotArchive(true)
+	if err != nil {
+		t.Fatalf("SnapshotArchive() failed: %v", err)
+	}
+	f.Close()
+	if sum1 == sum3 {
+		t.Fatalf("expected archive to be refreshed")
+	}
+
+	// Releasing a previous archive shouldn't remove the current one
+	if err := d.ReleaseSnapshotArchive(sum1); err != nil {
+		t.Fatalf("ReleaseSnapshotArchive() failed: %v", err)
+	}
+	if _, err := os.Stat(d.archivePath()); err != nil {
+		t.Fatalf("expected archive to exist: %v", err)
+	}
+	if err := d.ReleaseSnapshotArchive(sum3); err != nil {
+		t.Fatalf("ReleaseSnapshotArchive() failed: %v", err)
+	}
+	if _, err := os.Stat(d.archivePath()); !os.IsNotExist(err) {
+		t.Fatalf("expected archive to be removed: %v", err)
+	}
+
+	// An archive left by a previous run is removed regardless of checksum
+	if err := ioutil.WriteFile(d.archivePath(), []byte("foo"), 0600); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	if err := d.RemoveSnapshotArchive(); err != nil {
+		t.Fatalf("RemoveSnapshotArchive() failed: %v", err)
+	}
+	if _, err := os.Stat(d.archivePath()); !os.IsNotExist(err) {
+		t.Fatalf("expected archive to be removed: %v", err)
+	}
+
+	if err := d.Destroy(); err != nil {
+		t.Fatalf("Destroy() failed: %v", err)
+	}
+	if _, err := os.Stat(d.archivePath()); !os.IsNotExist(err) {
+		t.Fatalf("expected archive to be removed: %v", err)
+	}
+}
+
+func TestAllocDir_Restore(t *testing.T) {
+	tmp1, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp1)
+
+	tmp2, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp2)
+
+	d1 := NewAllocDir(testLogger(), tmp1)
+	defer d1.Destroy()
+	if err := d1.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	td1 := d1.NewTaskDir(t1.Name)
+	if err := td1.Build(false, nil, cstructs.FSIsolationImage); err != nil {
+		t.Fatalf("error build task=%q dir: %v", t1.Name, err)
+	}
+
+	// Write a file to the shared dir and the task local dir
+	if err := ioutil.WriteFile(filepath.Join(d1.SharedDir, SharedDataDir, "bar"), []byte("foo"), 0666); err != nil {
+		t.Fatalf("Couldn't write file to shared directory: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(td1.LocalDir, "nested"), 0777); err != nil {
+		t.Fatalf("Couldn't create dir in task local directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(td1.LocalDir, "nested", "lol"), []byte("bar"), 0640); err != nil {
+		t.Fatalf("couldn't write to task local directory: %v", err)
+	}
+
+	var b bytes.Buffer
+	if err := d1.Snapshot(&b); err != nil {
+		t.Fatalf("Snapshot() failed: %v", err)
+	}
+
+	d2 := NewAllocDir(testLogger(), tmp2)
+	defer d2.Destroy()
+	if err := d2.Restore(&b, nil); err != nil {
+		t.Fatalf("Restore() failed: %v", err)
+	}
+
+	expected := map[string]string{
+		filepath.Join(tmp2, SharedAllocName, SharedDataDir, "bar"): "foo",
+		filepath.Join(tmp2, t1.Name, TaskLocal, "nested", "lol"):   "bar",
+	}
+	for path, exp := range expected {
+		out, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Couldn't read restored file %q: %v", path, err)
+		}
+		if string(out) != exp {
+			t.Fatalf("restored file %q contains %q; expected %q", path, out, exp)
+		}
+	}
+
+	fi, err := os.Stat(filepath.Join(tmp2, t1.Name, TaskLocal, "nested", "lol"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("restored file has mode %v; expected 0640", fi.Mode().Perm())
+	}
+}
+
+func TestAllocDir_Restore_Archive(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d1 := NewAllocDir(testLogger(), filepath.Join(tmp, "alloc1"))
+	defer d1.Destroy()
+	if err := d1.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(d1.SharedDir, SharedDataDir, "bar"), []byte("foo"), 0666); err != nil {
+		t.Fatalf("Couldn't write file to shared directory: %v", err)
+	}
+
+	f, _, err := d1.SnapshotArchive(true)
+	if err != nil {
+		t.Fatalf("SnapshotArchive() failed: %v", err)
+	}
+	defer f.Close()
+
+	// The archive is gzipped
+	if _, err := gzip.NewReader(f); err != nil {
+		t.Fatalf("expected a gzipped archive: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	d2 := NewAllocDir(testLogger(), filepath.Join(tmp, "alloc2"))
+	defer d2.Destroy()
+	if err := d2.Restore(f, nil); err != nil {
+		t.Fatalf("Restore() failed: %v", err)
+	}
+	out, err := ioutil.ReadFile(filepath.Join(d2.SharedDir, SharedDataDir, "bar"))
+	if err != nil || string(out) != "foo" {
+		t.Fatalf("expected restored file; got %q: %v", out, err)
+	}
+}
+
+func TestAllocDir_Restore_Stopped(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d1 := NewAllocDir(testLogger(), filepath.Join(tmp, "alloc1"))
+	defer d1.Destroy()
+	if err := d1.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	var b bytes.Buffer
+	if err := d1.Snapshot(&b); err != nil {
+		t.Fatalf("Snapshot() failed: %v", err)
+	}
+
+	stopCh := make(chan struct{})
+	close(stopCh)
+	d2 := NewAllocDir(testLogger(), filepath.Join(tmp, "alloc2"))
+	if err := d2.Restore(&b, stopCh); err != ErrRestoreStopped {
+		t.Fatalf("expected restore to be stopped; got %v", err)
+	}
+}
+
+func TestAllocDir_Restore_Escape(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	data := []byte("foo")
+	hdr := &tar.Header{
+		Name:     "../escaped",
+		Mode:     0666,
+		Size:     int64(len(data)),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tw.Write(data)
+	tw.Close()
+
+	d := NewAllocDir(testLogger(), filepath.Join(tmp, "alloc"))
+	if err := d.Restore(&b, nil); err == nil {
+		t.Fatalf("expected an error restoring a path outside the alloc dir")
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "escaped")); !os.IsNotExist(err) {
+		t.Fatalf("file outside the alloc dir was written: %v", err)
+	}
+}
+
 func TestAllocDir_Move(t *testing.T) {
 	tmp1, err := ioutil.TempDir("", "AllocDir")
 	if err != nil {
@@ -425,3 +679,80 @@ func TestPathFuncs(t *testing.T) {
 		t.Errorf("%q is not empty. empty=%v error=%v", dir, empty, err)
 	}
 }
+
+// Test that DiskUsage counts the files written by the allocation.
+func TestAllocDir_DiskUsage(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), tmp)
+	defer d.Destroy()
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	td := d.NewTaskDir(t1.Name)
+	if err := td.Build(false, nil, cstructs.FSIsolationNone); err != nil {
+		t.Fatalf("error build task=%q dir: %v", t1.Name, err)
+	}
+
+	data := bytes.Repeat([]byte{'a'}, 64*1024)
+	if err := ioutil.WriteFile(filepath.Join(td.LocalDir, "foo"), data, 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+
+	// A hardlink shouldn't be counted twice
+	if err := os.Link(filepath.Join(td.LocalDir, "foo"), filepath.Join(td.LocalDir, "bar")); err != nil {
+		t.Fatalf("Link() failed: %v", err)
+	}
+
+	used, err := d.DiskUsage()
+	if err != nil {
+		t.Fatalf("DiskUsage() failed: %v", err)
+	}
+	if used < uint64(len(data)) || used >= 2*uint64(len(data)) {
+		t.Fatalf("unexpected disk usage %d for %d bytes written", used, len(data))
+	}
+}
+
+// Test that DiskUsage doesn't count files hardlinked from outside the alloc
+// dir, such as chroot entries.
+func TestAllocDir_DiskUsage_HostLinks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), filepath.Join(tmp, "alloc"))
+	defer d.Destroy()
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	td := d.NewTaskDir(t1.Name)
+	if err := td.Build(false, nil, cstructs.FSIsolationNone); err != nil {
+		t.Fatalf("error build task=%q dir: %v", t1.Name, err)
+	}
+
+	data := bytes.Repeat([]byte{'a'}, 64*1024)
+	host := filepath.Join(tmp, "host")
+	if err := ioutil.WriteFile(host, data, 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(td.Dir, "bin"), 0777); err != nil {
+		t.Fatalf("MkdirAll() failed: %v", err)
+	}
+	if err := os.Link(host, filepath.Join(td.Dir, "bin", "host")); err != nil {
+		t.Fatalf("Link() failed: %v", err)
+	}
+
+	used, err := d.DiskUsage()
+	if err != nil {
+		t.Fatalf("DiskUsage() failed: %v", err)
+	}
+	if used >= uint64(len(data)) {
+		t.Fatalf("unexpected disk usage %d; host file of %d bytes counted", used, len(data))
+	}
+}
@@ -0,0 +1,57 @@
+package allocdir
+
+import (
+	"sync"
+)
+
+// busyMount is a mount that unlinkDir found busy.
+type busyMount struct {
+	dir   string
+	mount mountRef
+
+	// err is the error detaching the mount if it couldn't be detached
+	err error
+}
+
+// busyMounts tracks the busy mounts until no process holds them anymore.
+var busyMounts struct {
+	sync.Mutex
+	mounts []*busyMount
+}
+
+// trackBusyMount records a mount found busy so it's reported by BusyMounts
+// until it's released.
+func trackBusyMount(dir string, mount mountRef, err error) {
+	busyMounts.Lock()
+	defer busyMounts.Unlock()
+	busyMounts.mounts = append(busyMounts.mounts, &busyMount{
+		dir:   dir,
+		mount: mount,
+		err:   err,
+	})
+}
+
+// BusyMounts describes the mounts in allocation directories that couldn't be
+// unmounted because they were in use and are still held by a process,
+// including the PIDs holding them. Mounts that are no longer held are
+// forgotten. Finding the holders walks /proc so it shouldn't be called
+// frequently.
+func BusyMounts() []string {
+	busyMounts.Lock()
+	defer busyMounts.Unlock()
+
+	var held []*busyMount
+	var desc []string
+	for _, b := range busyMounts.mounts {
+		pids := mountHolders(b.mount)
+		if len(pids) == 0 {
+			continue
+		}
+		held = append(held, b)
+
+		e := &busyMountError{Dir: b.dir, Pids: pids, Err: b.err}
+		desc = append(desc, e.Error())
+	}
+	busyMounts.mounts = held
+	return desc
+}
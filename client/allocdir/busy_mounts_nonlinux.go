@@ -0,0 +1,9 @@
+// +build !linux
+
+package allocdir
+
+// BusyMounts is currently a noop on non-Linux platforms as mounts aren't
+// retried or detached there.
+func BusyMounts() []string {
+	return nil
+}
@@ -0,0 +1,170 @@
+package allocdir
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// chownPaths changes the owner of each path beneath root to the named user and
+// their primary group, descending into directories on the same filesystem if
+// recursive is set. Paths are resolved relative to root without following
+// symlinks and files with more than one link are skipped, so a task can't
+// trick Nomad into changing the owner of a file outside of root. Paths that
+// don't exist are ignored. Nothing is done if not running as root.
+func chownPaths(root string, paths []string, username string, recursive bool) error {
+	// Can't change owner if not root.
+	if unix.Geteuid() != 0 {
+		return nil
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+
+	uid, err := getUid(u)
+	if err != nil {
+		return err
+	}
+
+	gid, err := getGid(u)
+	if err != nil {
+		return err
+	}
+
+	rootFd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootFd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(rootFd, &st); err != nil {
+		return &os.PathError{Op: "stat", Path: root, Err: err}
+	}
+
+	c := &chowner{uid: uid, gid: gid, dev: uint64(st.Dev), recursive: recursive}
+	for _, path := range paths {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("path %q isn't in %q", path, root)
+		}
+		if err := c.chownRel(rootFd, rel); err != nil {
+			return fmt.Errorf("failed to change owner of %q: %v", path, err)
+		}
+	}
+
+	return nil
+}
+
+// chowner changes the owner of files relative to open directories.
+type chowner struct {
+	uid, gid  int
+	dev       uint64
+	recursive bool
+}
+
+// chownRel changes the owner of the path rel relative to the directory dirFd,
+// opening each of its parents without following symlinks.
+func (c *chowner) chownRel(dirFd int, rel string) error {
+	if rel == "." {
+		return c.chownFd(dirFd)
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+	fd := dirFd
+	for _, part := range parts[:len(parts)-1] {
+		next, err := unix.Openat(fd, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if fd != dirFd {
+			unix.Close(fd)
+		}
+		if err != nil {
+			// Missing parents or symlinks in place of them have nothing
+			// for Nomad to change.
+			if err == unix.ENOENT || err == unix.ELOOP || err == unix.ENOTDIR {
+				return nil
+			}
+			return err
+		}
+		fd = next
+	}
+	if fd != dirFd {
+		defer unix.Close(fd)
+	}
+
+	return c.chownAt(fd, parts[len(parts)-1])
+}
+
+// chownAt changes the owner of name in the directory dirFd.
+func (c *chowner) chownAt(dirFd int, name string) error {
+	// Devices, FIFOs and sockets aren't created by Nomad so opening them
+	// without blocking and failing on sockets is fine.
+	fd, err := unix.Openat(dirFd, name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	switch err {
+	case nil:
+	case unix.ELOOP:
+		// Symlinks are changed themselves rather than what they point to
+		err := unix.Fchownat(dirFd, name, c.uid, c.gid, unix.AT_SYMLINK_NOFOLLOW)
+		if err == unix.ENOENT {
+			return nil
+		}
+		return err
+	case unix.ENOENT, unix.ENXIO:
+		return nil
+	default:
+		return err
+	}
+	defer unix.Close(fd)
+
+	return c.chownFd(fd)
+}
+
+// chownFd changes the owner of the open file fd and, if it's a directory and
+// recursive is set, everything in it.
+func (c *chowner) chownFd(fd int) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+
+	// Don't change other mounts or files hardlinked from elsewhere
+	isDir := st.Mode&unix.S_IFMT == unix.S_IFDIR
+	if uint64(st.Dev) != c.dev || (!isDir && st.Nlink > 1) {
+		return nil
+	}
+
+	if err := unix.Fchown(fd, c.uid, c.gid); err != nil {
+		return err
+	}
+	if !isDir || !c.recursive {
+		return nil
+	}
+
+	// Read the entries through a duplicate as closing the file closes its
+	// descriptor.
+	dup, err := unix.Dup(fd)
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(dup), "")
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := c.chownAt(fd, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
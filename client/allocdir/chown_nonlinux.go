@@ -0,0 +1,8 @@
+// +build !linux
+
+package allocdir
+
+// chownPaths is currently a noop on non-Linux platforms
+func chownPaths(root string, paths []string, username string, recursive bool) error {
+	return nil
+}
@@ -0,0 +1,101 @@
+package allocdir
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	cstructs "github.com/hashicorp/nomad/client/structs"
+)
+
+// DiskWatcher periodically measures the disk usage of an allocation directory
+// and notifies a callback when the usage first exceeds the allocation's limit.
+type DiskWatcher struct {
+	allocDir *AllocDir
+	interval time.Duration
+	limitMB  int
+
+	// exceededFn is called when the usage goes over the limit. It is called
+	// again only after the usage has dropped below the limit in between.
+	exceededFn func(usage *cstructs.DiskUsage)
+
+	usage     *cstructs.DiskUsage
+	usageLock sync.RWMutex
+
+	shutdownCh   chan struct{}
+	shutdown     bool
+	shutdownLock sync.Mutex
+
+	logger *log.Logger
+}
+
+// NewDiskWatcher returns a DiskWatcher for the allocation directory. A zero
+// limitMB disables limit checking. Call Run to start measuring.
+func NewDiskWatcher(logger *log.Logger, allocDir *AllocDir, interval time.Duration,
+	limitMB int, exceededFn func(usage *cstructs.DiskUsage)) *DiskWatcher {
+	return &DiskWatcher{
+		allocDir:   allocDir,
+		interval:   interval,
+		limitMB:    limitMB,
+		exceededFn: exceededFn,
+		shutdownCh: make(chan struct{}),
+		logger:     logger,
+	}
+}
+
+// Run measures the disk usage every interval until Shutdown is called.
+func (w *DiskWatcher) Run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			timer.Reset(w.interval)
+		case <-w.shutdownCh:
+			return
+		}
+
+		used, err := w.allocDir.DiskUsage()
+		if err != nil {
+			w.logger.Printf("[WARN] client: failed to measure disk usage of %q: %v", w.allocDir.AllocDir, err)
+			continue
+		}
+
+		usage := &cstructs.DiskUsage{
+			UsedBytes: used,
+			LimitMB:   w.limitMB,
+			Exceeded:  w.limitMB > 0 && used > uint64(w.limitMB)*1024*1024,
+			Timestamp: time.Now().UTC().UnixNano(),
+		}
+
+		w.usageLock.Lock()
+		prev := w.usage
+		w.usage = usage
+		w.usageLock.Unlock()
+
+		if usage.Exceeded && (prev == nil || !prev.Exceeded) && w.exceededFn != nil {
+			w.exceededFn(usage)
+		}
+	}
+}
+
+// LatestUsage returns the last measured disk usage or nil if it hasn't been
+// measured yet.
+func (w *DiskWatcher) LatestUsage() *cstructs.DiskUsage {
+	w.usageLock.RLock()
+	defer w.usageLock.RUnlock()
+	return w.usage
+}
+
+// Shutdown stops the watcher. It is safe to call multiple times.
+func (w *DiskWatcher) Shutdown() {
+	w.shutdownLock.Lock()
+	defer w.shutdownLock.Unlock()
+
+	if w.shutdown {
+		return
+	}
+	w.shutdown = true
+	close(w.shutdownCh)
+}
@@ -0,0 +1,52 @@
+package allocdir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cstructs "github.com/hashicorp/nomad/client/structs"
+)
+
+func TestDiskWatcher_Exceeded(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), tmp)
+	defer d.Destroy()
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	exceededCh := make(chan *cstructs.DiskUsage, 1)
+	w := NewDiskWatcher(testLogger(), d, 10*time.Millisecond, 1, func(u *cstructs.DiskUsage) {
+		exceededCh <- u
+	})
+	go w.Run()
+	defer w.Shutdown()
+
+	// Write more than the limit
+	data := bytes.Repeat([]byte{'a'}, 2*1024*1024)
+	if err := ioutil.WriteFile(filepath.Join(d.SharedDir, SharedDataDir, "big"), data, 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+
+	select {
+	case u := <-exceededCh:
+		if !u.Exceeded || u.UsedBytes < uint64(len(data)) {
+			t.Fatalf("bad usage: %#v", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for disk limit to be exceeded")
+	}
+
+	if u := w.LatestUsage(); u == nil || !u.Exceeded {
+		t.Fatalf("bad latest usage: %#v", u)
+	}
+}
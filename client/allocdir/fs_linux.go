@@ -1,23 +1,62 @@
 package allocdir
 
 import (
+	"bufio"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/armon/go-metrics"
 	"golang.org/x/sys/unix"
 )
 
 const (
-	// secretDirTmpfsSize is the size of the tmpfs per task in MBs
+	// secretDirTmpfsSize is the default size of the tmpfs per task in MBs
 	secretDirTmpfsSize = 1
 
 	// secretMarker is the filename of the marker created so Nomad doesn't
 	// try to mount the secrets tmpfs more than once
 	secretMarker = ".nomad-mount"
+
+	// unmountAttempts is the number of times unmounting a busy mount is
+	// attempted before it is lazily detached.
+	unmountAttempts = 5
+
+	// unmountBackoff is the initial delay between unmount attempts. It
+	// doubles after each attempt.
+	unmountBackoff = 50 * time.Millisecond
 )
 
+// busyMountError is returned when a mount couldn't be unmounted because it was
+// in use. Unless detaching it also failed, the mount was lazily detached so it
+// is no longer visible but is kept alive until the holders release it.
+type busyMountError struct {
+	Dir  string
+	Pids []int
+	Err  error
+}
+
+func (e *busyMountError) Error() string {
+	holders := "unknown processes"
+	if len(e.Pids) > 0 {
+		pids := make([]string, len(e.Pids))
+		for i, pid := range e.Pids {
+			pids[i] = strconv.Itoa(pid)
+		}
+		holders = "PIDs " + strings.Join(pids, ", ")
+	}
+
+	if e.Err != nil {
+		return fmt.Sprintf("mount %q is busy (held by %s) and couldn't be detached: %v", e.Dir, holders, e.Err)
+	}
+	return fmt.Sprintf("mount %q was busy (held by %s) and was lazily detached", e.Dir, holders)
+}
+
 // linkDir bind mounts src to dst as Linux doesn't support hardlinking
 // directories.
 func linkDir(src, dst string) error {
@@ -30,19 +69,140 @@ func linkDir(src, dst string) error {
 
 // unlinkDir unmounts a bind mounted directory as Linux doesn't support
 // hardlinking directories. If the dir is already unmounted no error is
-// returned.
+// returned. Unmounting a busy mount is retried with backoff before the mount is
+// lazily detached, in which case a busyMountError naming the processes using
+// the mount is returned. Busy and detached mounts are counted in the
+// client.mounts.busy and client.mounts.detached metrics and tracked until they
+// are released so they can be reported by BusyMounts.
 func unlinkDir(dir string) error {
-	if err := syscall.Unmount(dir, 0); err != nil {
-		if err != syscall.EINVAL {
+	backoff := unmountBackoff
+	for attempt := 1; ; attempt++ {
+		err := syscall.Unmount(dir, 0)
+		if err == nil || err == syscall.EINVAL {
+			return nil
+		}
+		if err != syscall.EBUSY {
 			return err
 		}
+		if attempt == unmountAttempts {
+			break
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	// Find the mount before detaching as its path can't be resolved after
+	metrics.IncrCounter([]string{"client", "mounts", "busy"}, 1)
+	busy := &busyMountError{Dir: dir}
+	mount, mountErr := fileMount(dir)
+	if mountErr == nil {
+		busy.Pids = mountHolders(mount)
 	}
-	return nil
+	if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil {
+		busy.Err = err
+	} else {
+		metrics.IncrCounter([]string{"client", "mounts", "detached"}, 1)
+	}
+	if mountErr == nil {
+		trackBusyMount(dir, mount, busy.Err)
+	}
+	return busy
+}
+
+// mountHolders returns the PIDs of processes with an open file, working
+// directory, root or executable on the given mount. Holders are matched by the
+// mount their files are on rather than by path so processes that see the mount
+// under another path, such as those chrooted into a task dir, and mounts that
+// were detached are found too.
+func mountHolders(mount mountRef) []int {
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	var pids []int
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+
+		base := filepath.Join("/proc", proc.Name())
+		links := []string{"cwd", "root", "exe"}
+		if fds, err := ioutil.ReadDir(filepath.Join(base, "fd")); err == nil {
+			for _, fd := range fds {
+				links = append(links, filepath.Join("fd", fd.Name()))
+			}
+		}
+
+		for _, link := range links {
+			m, err := fileMount(filepath.Join(base, link))
+			if err != nil {
+				continue
+			}
+			if m.same(mount) {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids
+}
+
+// mountRef identifies the mount a file is on by its mount ID, or by its
+// device if the kernel doesn't report mount IDs.
+type mountRef struct {
+	id  int
+	dev uint64
+}
+
+// same returns whether both files are on the same mount. Bind mounts share the
+// device of their source so devices are only compared without mount IDs.
+func (m mountRef) same(o mountRef) bool {
+	if m.id >= 0 && o.id >= 0 {
+		return m.id == o.id
+	}
+	return m.dev == o.dev
+}
+
+// fileMount returns the mount the file at path is on. Links in /proc to the
+// files of other processes are resolved by the kernel without following the
+// path they print, so files outside of Nomad's view of the filesystem are
+// resolved correctly.
+func fileMount(path string) (mountRef, error) {
+	ref := mountRef{id: -1}
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return ref, err
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return ref, err
+	}
+	ref.dev = uint64(st.Dev)
+
+	// The mount ID is reported since Linux 3.15
+	info, err := ioutil.ReadFile(fmt.Sprintf("/proc/self/fdinfo/%d", fd))
+	if err != nil {
+		return ref, nil
+	}
+	for _, line := range strings.Split(string(info), "\n") {
+		if !strings.HasPrefix(line, "mnt_id:") {
+			continue
+		}
+		if id, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "mnt_id:"))); err == nil {
+			ref.id = id
+		}
+	}
+	return ref, nil
 }
 
 // createSecretDir creates the secrets dir folder at the given path using a
-// tmpfs
-func createSecretDir(dir string) error {
+// tmpfs of the given size in MBs. If size is zero the default size is used.
+func createSecretDir(dir string, size int) error {
 	// Only mount the tmpfs if we are root
 	if unix.Geteuid() == 0 {
 		if err := os.MkdirAll(dir, 0777); err != nil {
@@ -55,9 +215,13 @@ func createSecretDir(dir string) error {
 			return nil
 		}
 
+		if size == 0 {
+			size = secretDirTmpfsSize
+		}
+
 		var flags uintptr
 		flags = syscall.MS_NOEXEC
-		options := fmt.Sprintf("size=%dm", secretDirTmpfsSize)
+		options := fmt.Sprintf("size=%dm", size)
 		if err := syscall.Mount("tmpfs", dir, "tmpfs", flags, options); err != nil {
 			return os.NewSyscallError("mount", err)
 		}
@@ -88,3 +252,50 @@ func removeSecretDir(dir string) error {
 	}
 	return os.RemoveAll(dir)
 }
+
+// mountInfo describes a mount from /proc/self/mountinfo
+type mountInfo struct {
+	MountPoint string
+	FSType     string
+	Source     string
+}
+
+// mounts returns the mounts visible to the process in the order they were
+// mounted.
+func mounts() ([]mountInfo, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Spaces and other special characters are octal escaped
+	unescape := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+	var all []mountInfo
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: id parent major:minor root mountpoint opts ... - fstype source superopts
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep == -1 || len(fields) < sep+3 {
+			continue
+		}
+
+		all = append(all, mountInfo{
+			MountPoint: unescape.Replace(fields[4]),
+			FSType:     fields[sep+1],
+			Source:     unescape.Replace(fields[sep+2]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
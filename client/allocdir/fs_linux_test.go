@@ -6,8 +6,10 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 
 	"golang.org/x/sys/unix"
@@ -70,11 +72,11 @@ func TestLinuxRootSecretDir(t *testing.T) {
 	}
 
 	// creating a secrets dir should work
-	if err := createSecretDir(secretsDir); err != nil {
+	if err := createSecretDir(secretsDir, 0); err != nil {
 		t.Fatalf("error creating secrets dir %q: %v", secretsDir, err)
 	}
 	// creating it again should be a noop (NO error)
-	if err := createSecretDir(secretsDir); err != nil {
+	if err := createSecretDir(secretsDir, 0); err != nil {
 		t.Fatalf("error creating secrets dir %q: %v", secretsDir, err)
 	}
 
@@ -130,11 +132,11 @@ func TestLinuxUnprivilegedSecretDir(t *testing.T) {
 	}
 
 	// creating a secrets dir should work
-	if err := createSecretDir(secretsDir); err != nil {
+	if err := createSecretDir(secretsDir, 0); err != nil {
 		t.Fatalf("error creating secrets dir %q: %v", secretsDir, err)
 	}
 	// creating it again should be a noop (NO error)
-	if err := createSecretDir(secretsDir); err != nil {
+	if err := createSecretDir(secretsDir, 0); err != nil {
 		t.Fatalf("error creating secrets dir %q: %v", secretsDir, err)
 	}
 
@@ -165,3 +167,143 @@ func TestLinuxUnprivilegedSecretDir(t *testing.T) {
 		t.Fatalf("error removing nonexistent secrets dir %q: %v", secretsDir, err)
 	}
 }
+
+// TestLinuxRootBusyUnmount asserts a busy mount is lazily detached and the
+// processes holding it are reported.
+func TestLinuxRootBusyUnmount(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+	tmp, err := ioutil.TempDir("", "nomadtest-busy")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	dst := filepath.Join(tmp, "dst")
+	if err := os.MkdirAll(src, 0777); err != nil {
+		t.Fatalf("error creating %q: %v", src, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "foo"), []byte("foo"), 0666); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if err := linkDir(src, dst); err != nil {
+		t.Fatalf("error linking %q: %v", dst, err)
+	}
+
+	// Holding a file open through the mount keeps it busy
+	f, err := os.Open(filepath.Join(dst, "foo"))
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	defer f.Close()
+
+	err = unlinkDir(dst)
+	busy, ok := err.(*busyMountError)
+	if !ok {
+		t.Fatalf("expected a busy mount error; got %v", err)
+	}
+	if busy.Err != nil {
+		t.Fatalf("expected mount to be detached: %v", busy.Err)
+	}
+
+	found := false
+	for _, pid := range busy.Pids {
+		if pid == os.Getpid() {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected PID %d to hold the mount; got %v", os.Getpid(), busy.Pids)
+	}
+
+	if mounted, err := isMountPoint(dst); err != nil || mounted {
+		t.Fatalf("expected %q to be detached: %v", dst, err)
+	}
+
+	// The detached mount is reported until it's released
+	busyMounts := func() bool {
+		for _, desc := range BusyMounts() {
+			if strings.Contains(desc, dst) {
+				return true
+			}
+		}
+		return false
+	}
+	if !busyMounts() {
+		t.Fatalf("expected %q to be reported as busy; got %v", dst, BusyMounts())
+	}
+	f.Close()
+	if busyMounts() {
+		t.Fatalf("expected %q to no longer be reported as busy", dst)
+	}
+}
+
+// TestLinuxRootMountHolders asserts the holders of a mount are found by the
+// mount they use rather than the device it shares with other bind mounts.
+func TestLinuxRootMountHolders(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+	tmp, err := ioutil.TempDir("", "nomadtest-holders")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	if err := os.MkdirAll(src, 0777); err != nil {
+		t.Fatalf("error creating %q: %v", src, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "foo"), []byte("foo"), 0666); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	dst1 := filepath.Join(tmp, "dst1")
+	dst2 := filepath.Join(tmp, "dst2")
+	for _, dst := range []string{dst1, dst2} {
+		if err := linkDir(src, dst); err != nil {
+			t.Fatalf("error linking %q: %v", dst, err)
+		}
+		defer syscall.Unmount(dst, syscall.MNT_DETACH)
+	}
+
+	mount, err := fileMount(dst1)
+	if err != nil {
+		t.Fatalf("error finding mount of %q: %v", dst1, err)
+	}
+
+	// A file open through another bind mount of the same source doesn't
+	// hold the mount
+	f, err := os.Open(filepath.Join(dst2, "foo"))
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	defer f.Close()
+	for _, pid := range mountHolders(mount) {
+		if pid == os.Getpid() {
+			t.Fatalf("expected PID %d not to hold %q", pid, dst1)
+		}
+	}
+
+	// A process working in the mount holds it
+	cmd := exec.Command("sleep", "60")
+	cmd.Dir = dst1
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("error starting process: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	found := false
+	for _, pid := range mountHolders(mount) {
+		if pid == cmd.Process.Pid {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected PID %d to hold %q", cmd.Process.Pid, dst1)
+	}
+}
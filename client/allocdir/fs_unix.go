@@ -8,6 +8,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
@@ -96,3 +97,31 @@ func linkOrCopy(src, dst string, perm os.FileMode) error {
 
 	return fileCopy(src, dst, perm)
 }
+
+// diskUsage returns the number of bytes allocated on disk for a file, its
+// inode number and its number of links.
+func diskUsage(info os.FileInfo) (uint64, uint64, uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return uint64(st.Blocks) * 512, uint64(st.Ino), uint64(st.Nlink), true
+}
+
+// fileOwner returns the user and group IDs owning the file.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// fileDevice returns the ID of the device containing the file.
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
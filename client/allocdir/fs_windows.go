@@ -41,7 +41,7 @@ func unlinkDir(dir string) error {
 }
 
 // createSecretDir creates the secrets dir folder at the given path
-func createSecretDir(dir string) error {
+func createSecretDir(dir string, size int) error {
 	return os.MkdirAll(dir, 0777)
 }
 
@@ -50,6 +50,21 @@ func removeSecretDir(dir string) error {
 	return os.RemoveAll(dir)
 }
 
+// diskUsage isn't available on windows so the file's size is used instead.
+func diskUsage(info os.FileInfo) (uint64, uint64, uint64, bool) {
+	return 0, 0, 0, false
+}
+
+// fileOwner isn't available on windows so ownership isn't preserved.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+// fileDevice isn't available on windows so mounts can't be detected.
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
 // The windows version does nothing currently.
 func dropDirPermissions(path string) error {
 	return nil
@@ -0,0 +1,217 @@
+package allocdir
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// Loop device ioctls from linux/loop.h
+	loopSetFd       = 0x4C00
+	loopClrFd       = 0x4C01
+	loopSetStatus64 = 0x4C04
+	loopCtlGetFree  = 0x4C82
+
+	// loFlagsAutoclear detaches the loop device when it is unmounted
+	loFlagsAutoclear = 4
+
+	// loopAttachAttempts is the number of times attaching a free loop device
+	// is retried as another process may claim it first.
+	loopAttachAttempts = 5
+)
+
+// loopInfo64 mirrors struct loop_info64 from linux/loop.h
+type loopInfo64 struct {
+	device         uint64
+	inode          uint64
+	rdevice        uint64
+	offset         uint64
+	sizelimit      uint64
+	number         uint32
+	encryptType    uint32
+	encryptKeySize uint32
+	flags          uint32
+	fileName       [64]byte
+	cryptName      [64]byte
+	encryptKey     [32]byte
+	init           [2]uint64
+}
+
+// mountImage mounts an ext4 image of sizeMB at dir using a loop device. The
+// image is created if it doesn't exist and removed again if it can't be
+// mounted. If dir is already mounted nothing is done.
+func mountImage(dir, image string, sizeMB int) error {
+	if mounted, err := isMountPoint(dir); err != nil {
+		return err
+	} else if mounted {
+		return nil
+	}
+
+	created := false
+	if !pathExists(image) {
+		if err := createImage(image, sizeMB); err != nil {
+			os.Remove(image)
+			return err
+		}
+		created = true
+	}
+
+	// Don't leave a preallocated image behind if it was never used
+	removeCreated := func() {
+		if created {
+			os.Remove(image)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		removeCreated()
+		return err
+	}
+
+	loop, err := attachLoop(image)
+	if err != nil {
+		removeCreated()
+		return err
+	}
+	if err := syscall.Mount(loop.Name(), dir, "ext4", 0, ""); err != nil {
+		detachLoop(loop)
+		loop.Close()
+		removeCreated()
+		return fmt.Errorf("Couldn't mount image %q at %q: %v", image, dir, err)
+	}
+
+	// The loop device is detached automatically when unmounted
+	loop.Close()
+
+	// Hide the filesystem's lost+found from the allocation
+	if created {
+		os.Remove(filepath.Join(dir, "lost+found"))
+	}
+	return nil
+}
+
+// remountImage mounts the existing image at dir, for example after a reboot.
+// Nothing is done if there is no image or it's already mounted.
+func remountImage(dir, image string) error {
+	if !pathExists(image) {
+		return nil
+	}
+	return mountImage(dir, image, 0)
+}
+
+// unmountImage unmounts dir if an image is mounted there and removes the
+// image. No error is returned if neither exist.
+func unmountImage(dir, image string) error {
+	mounted, err := isMountPoint(dir)
+	if err != nil {
+		return err
+	}
+
+	// A busy mount that was detached no longer needs the image path so it
+	// is still removed. Its space is freed once the mount is released.
+	var busy error
+	if mounted {
+		if err := unlinkDir(dir); err != nil {
+			if b, ok := err.(*busyMountError); !ok || b.Err != nil {
+				return fmt.Errorf("Failed to unmount image at %q: %v", dir, err)
+			}
+			busy = err
+		}
+	}
+
+	if err := os.Remove(image); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove image %q: %v", image, err)
+	}
+	return busy
+}
+
+// createImage creates a sparse file of sizeMB and formats it as ext4.
+func createImage(image string, sizeMB int) error {
+	f, err := os.OpenFile(image, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Couldn't create image %q: %v", image, err)
+	}
+	defer f.Close()
+
+	if err := f.Truncate(int64(sizeMB) * 1024 * 1024); err != nil {
+		return fmt.Errorf("Couldn't size image %q: %v", image, err)
+	}
+
+	// Don't reserve blocks for root so the allocation can use the full size
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", "-m", "0", image).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Couldn't format image %q: %v: %s", image, err, out)
+	}
+	return nil
+}
+
+// attachLoop attaches image to a free loop device and returns it opened.
+func attachLoop(image string) (*os.File, error) {
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer ctl.Close()
+
+	backing, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer backing.Close()
+
+	for i := 0; i < loopAttachAttempts; i++ {
+		index, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ctl.Fd(), loopCtlGetFree, 0)
+		if errno != 0 {
+			return nil, os.NewSyscallError("ioctl", errno)
+		}
+
+		loop, err := os.OpenFile(fmt.Sprintf("/dev/loop%d", index), os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, loop.Fd(), loopSetFd, backing.Fd()); errno != 0 {
+			loop.Close()
+
+			// Another process claimed the device first
+			if errno == syscall.EBUSY {
+				continue
+			}
+			return nil, os.NewSyscallError("ioctl", errno)
+		}
+
+		info := loopInfo64{flags: loFlagsAutoclear}
+		copy(info.fileName[:], image)
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, loop.Fd(), loopSetStatus64, uintptr(unsafe.Pointer(&info))); errno != 0 {
+			detachLoop(loop)
+			loop.Close()
+			return nil, os.NewSyscallError("ioctl", errno)
+		}
+		return loop, nil
+	}
+
+	return nil, fmt.Errorf("Couldn't find a free loop device for %q", image)
+}
+
+// detachLoop detaches the backing file from the loop device
+func detachLoop(loop *os.File) {
+	syscall.Syscall(syscall.SYS_IOCTL, loop.Fd(), loopClrFd, 0)
+}
+
+// isMountPoint returns whether path is a mount point
+func isMountPoint(path string) (bool, error) {
+	all, err := mounts()
+	if err != nil {
+		return false, err
+	}
+	for _, m := range all {
+		if m.MountPoint == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
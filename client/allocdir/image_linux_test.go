@@ -0,0 +1,223 @@
+package allocdir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	cstructs "github.com/hashicorp/nomad/client/structs"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"golang.org/x/sys/unix"
+)
+
+// TestLinuxRootImage asserts an image backed alloc dir limits writes and is
+// cleaned up on Destroy.
+func TestLinuxRootImage(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not found")
+	}
+	tmp, err := ioutil.TempDir("", "nomadtest-image")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), filepath.Join(tmp, "alloc"))
+	if err := d.MountImage(8); err != nil {
+		t.Skipf("Loop devices not available: %v", err)
+	}
+
+	// Mounting again should be a noop
+	if err := d.MountImage(8); err != nil {
+		t.Fatalf("MountImage() failed: %v", err)
+	}
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	// Writing more than the image size should fail
+	data := bytes.Repeat([]byte{'a'}, 16*1024*1024)
+	p := filepath.Join(d.SharedDir, SharedDataDir, "big")
+	if err := ioutil.WriteFile(p, data, 0666); err == nil {
+		t.Fatalf("expected writing beyond the image size to fail")
+	}
+
+	if err := d.Destroy(); err != nil {
+		t.Fatalf("Destroy() failed: %v", err)
+	}
+	if mounted, err := isMountPoint(d.AllocDir); err != nil || mounted {
+		t.Fatalf("expected %q to be unmounted: %v", d.AllocDir, err)
+	}
+	if _, err := os.Stat(d.imagePath()); !os.IsNotExist(err) {
+		t.Fatalf("expected image to be removed: %v", err)
+	}
+}
+
+// TestLinuxRootImage_Remount asserts a restored alloc dir's image is remounted
+// with its data.
+func TestLinuxRootImage_Remount(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not found")
+	}
+	tmp, err := ioutil.TempDir("", "nomadtest-image")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), filepath.Join(tmp, "alloc"))
+	if err := d.MountImage(8); err != nil {
+		t.Skipf("Loop devices not available: %v", err)
+	}
+	defer d.Destroy()
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	p := filepath.Join(d.SharedDir, SharedDataDir, "foo")
+	if err := ioutil.WriteFile(p, []byte("foo"), 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+
+	// Mimic a reboot
+	if err := syscall.Unmount(d.AllocDir, 0); err != nil {
+		t.Fatalf("Unmount() failed: %v", err)
+	}
+	if pathExists(p) {
+		t.Fatalf("expected %q to be hidden once unmounted", p)
+	}
+
+	if err := d.RemountImage(); err != nil {
+		t.Fatalf("RemountImage() failed: %v", err)
+	}
+	if data, err := ioutil.ReadFile(p); err != nil || string(data) != "foo" {
+		t.Fatalf("expected remounted data; got %q: %v", data, err)
+	}
+
+	// Alloc dirs without an image are left alone
+	other := NewAllocDir(testLogger(), filepath.Join(tmp, "other"))
+	if err := other.RemountImage(); err != nil {
+		t.Fatalf("RemountImage() failed: %v", err)
+	}
+	if pathExists(other.AllocDir) {
+		t.Fatalf("expected no alloc dir to be created")
+	}
+}
+
+// TestLinuxRootImage_Move asserts data can be moved between alloc dirs backed
+// by separate images.
+func TestLinuxRootImage_Move(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not found")
+	}
+	tmp, err := ioutil.TempDir("", "nomadtest-image")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d1 := NewAllocDir(testLogger(), filepath.Join(tmp, "alloc1"))
+	if err := d1.MountImage(8); err != nil {
+		t.Skipf("Loop devices not available: %v", err)
+	}
+	defer d1.Destroy()
+	if err := d1.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	d2 := NewAllocDir(testLogger(), filepath.Join(tmp, "alloc2"))
+	if err := d2.MountImage(8); err != nil {
+		t.Fatalf("MountImage() failed: %v", err)
+	}
+	defer d2.Destroy()
+	if err := d2.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	td1 := d1.NewTaskDir(t1.Name)
+	if err := td1.Build(false, nil, cstructs.FSIsolationImage); err != nil {
+		t.Fatalf("TaskDir.Build() failed: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(d1.SharedDir, SharedDataDir, "foo"), []byte("foo"), 0600); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	if err := os.Symlink("foo", filepath.Join(d1.SharedDir, SharedDataDir, "link")); err != nil {
+		t.Fatalf("Symlink() failed: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(td1.LocalDir, "bar"), []byte("bar"), 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+
+	if err := d2.Move(d1, []*structs.Task{t1}); err != nil {
+		t.Fatalf("Move() failed: %v", err)
+	}
+
+	fi, err := os.Stat(filepath.Join(d2.SharedDir, SharedDataDir, "foo"))
+	if err != nil {
+		t.Fatalf("data dir was not moved: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode to be preserved; got %v", fi.Mode())
+	}
+	if link, err := os.Readlink(filepath.Join(d2.SharedDir, SharedDataDir, "link")); err != nil || link != "foo" {
+		t.Fatalf("expected symlink to be moved; got %q: %v", link, err)
+	}
+	if _, err := os.Stat(filepath.Join(d2.AllocDir, t1.Name, TaskLocal, "bar")); err != nil {
+		t.Fatalf("task local dir was not moved: %v", err)
+	}
+	if pathExists(filepath.Join(d1.SharedDir, SharedDataDir)) {
+		t.Fatalf("expected the previous data dir to be removed")
+	}
+}
+
+// TestLinuxRootImage_Failed asserts an image created for a mount that fails is
+// removed while an existing image is kept.
+func TestLinuxRootImage_Failed(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not found")
+	}
+	tmp, err := ioutil.TempDir("", "nomadtest-image")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// A file in place of the mount point fails the mount
+	dir := filepath.Join(tmp, "alloc")
+	if err := ioutil.WriteFile(dir, nil, 0644); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	image := filepath.Join(tmp, "alloc.img")
+	if err := mountImage(dir, image, 8); err == nil {
+		t.Fatalf("expected mounting the image to fail")
+	}
+	if _, err := os.Stat(image); !os.IsNotExist(err) {
+		t.Fatalf("expected image to be removed: %v", err)
+	}
+
+	// An image that already existed is kept
+	if err := ioutil.WriteFile(image, []byte("foo"), 0600); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	if err := mountImage(dir, image, 8); err == nil {
+		t.Fatalf("expected mounting the image to fail")
+	}
+	if _, err := os.Stat(image); err != nil {
+		t.Fatalf("expected image to be kept: %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+// +build !linux
+
+package allocdir
+
+import (
+	"errors"
+)
+
+// mountImage is currently unsupported on non-Linux platforms
+func mountImage(dir, image string, sizeMB int) error {
+	return errors.New("Image backed alloc dirs are only supported on Linux")
+}
+
+// remountImage is currently a noop on non-Linux platforms as no images exist
+func remountImage(dir, image string) error {
+	return nil
+}
+
+// unmountImage is currently a noop on non-Linux platforms
+func unmountImage(dir, image string) error {
+	return nil
+}
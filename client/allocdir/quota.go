@@ -0,0 +1,9 @@
+package allocdir
+
+import (
+	"errors"
+)
+
+// ErrQuotaUnsupported is returned when the filesystem backing a directory
+// doesn't support project quotas or they aren't enabled on it.
+var ErrQuotaUnsupported = errors.New("project quotas are not supported on this filesystem")
@@ -0,0 +1,307 @@
+package allocdir
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// fsIocFsGetXattr and fsIocFsSetXattr are the ioctls used to read and
+	// write the project ID of a file on xfs and ext4.
+	fsIocFsGetXattr = 0x801c581f
+	fsIocFsSetXattr = 0x401c5820
+
+	// fsXflagProjInherit causes new files in a directory to inherit its
+	// project ID.
+	fsXflagProjInherit = 0x00000200
+
+	// Quotactl commands and the project quota type.
+	qGetQuota = 0x800007
+	qSetQuota = 0x800008
+	prjQuota  = 2
+
+	// qifBLimits marks the block limits of a dqblk as valid.
+	qifBLimits = 1
+
+	// quotaProjectIDBase is the lowest project ID Nomad assigns so operator
+	// managed project IDs aren't disturbed.
+	quotaProjectIDBase = 1 << 20
+
+	// quotaProjectIDRange is the number of project IDs Nomad may assign.
+	quotaProjectIDRange = 1 << 30
+)
+
+// fsxattr mirrors struct fsxattr from linux/fs.h
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// dqblk mirrors struct if_dqblk from linux/quota.h
+type dqblk struct {
+	bhardlimit uint64
+	bsoftlimit uint64
+	curspace   uint64
+	ihardlimit uint64
+	isoftlimit uint64
+	curinodes  uint64
+	btime      uint64
+	itime      uint64
+	valid      uint32
+}
+
+// setQuota assigns a project ID to dir and limits the project's disk usage to
+// sizeMB. Only the given subdirectories of dir, and everything beneath them
+// on the same filesystem, are charged to the project. Other directories
+// created in dir, such as a chroot hardlinked from the host, aren't charged
+// and can be linked into as files can't be linked into a directory that
+// inherits a different project.
+func setQuota(dir string, subdirs []string, sizeMB int) error {
+	dev, err := quotaDevice(dir)
+	if err != nil {
+		return err
+	}
+
+	// Reuse the project ID if the directory already has one, for example
+	// when the quota is being resized.
+	attr, err := getFsxattr(dir)
+	if err != nil {
+		return err
+	}
+	id := attr.projid
+	if id < quotaProjectIDBase {
+		if id, err = freeProjectID(dev, dir); err != nil {
+			return err
+		}
+	}
+
+	if err := setProjectID(dir, id, false); err != nil {
+		return err
+	}
+	for _, sub := range subdirs {
+		if err := setProjectID(sub, id, true); err != nil {
+			return err
+		}
+	}
+
+	q := dqblk{
+		bhardlimit: uint64(sizeMB) * 1024,
+		bsoftlimit: uint64(sizeMB) * 1024,
+		valid:      qifBLimits,
+	}
+	if err := quotactl(qSetQuota, dev, id, &q); err != nil {
+		return fmt.Errorf("failed to set quota on %q: %v", dir, err)
+	}
+	return nil
+}
+
+// removeQuota clears the limits of the project assigned to dir so its
+// project ID can be reused. No error is returned if dir has no quota.
+func removeQuota(dir string) error {
+	dev, err := quotaDevice(dir)
+	if err != nil {
+		if err == ErrQuotaUnsupported {
+			return nil
+		}
+		return err
+	}
+
+	attr, err := getFsxattr(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if attr.projid < quotaProjectIDBase {
+		return nil
+	}
+
+	q := dqblk{valid: qifBLimits}
+	if err := quotactl(qSetQuota, dev, attr.projid, &q); err != nil {
+		return fmt.Errorf("failed to remove quota on %q: %v", dir, err)
+	}
+	return nil
+}
+
+// inheritQuota charges dirs, and everything beneath them on the same
+// filesystem, to the project of the quota set on dir by setQuota. Nothing is
+// done if dir has no quota.
+func inheritQuota(dir string, dirs []string) error {
+	attr, err := getFsxattr(dir)
+	if err != nil || attr.projid < quotaProjectIDBase {
+		// The filesystem doesn't support project IDs or no quota is set
+		return nil
+	}
+
+	for _, d := range dirs {
+		cur, err := getFsxattr(d)
+		if err != nil {
+			return err
+		}
+		if cur.projid == attr.projid && cur.xflags&fsXflagProjInherit != 0 {
+			continue
+		}
+		if err := setProjectID(d, attr.projid, true); err != nil {
+			return fmt.Errorf("failed to set quota on %q: %v", d, err)
+		}
+	}
+	return nil
+}
+
+// freeProjectID picks a project ID for dir that has no usage or limits. The
+// search starts at a hash of the path so IDs are stable for a given
+// directory.
+func freeProjectID(dev, dir string) (uint32, error) {
+	h := fnv.New32a()
+	h.Write([]byte(dir))
+	start := h.Sum32() % quotaProjectIDRange
+
+	for i := uint32(0); i < 1024; i++ {
+		id := quotaProjectIDBase + (start+i)%quotaProjectIDRange
+		var q dqblk
+		if err := quotactl(qGetQuota, dev, id, &q); err != nil {
+			// XFS reports projects that were never used as missing
+			if se, ok := err.(*os.SyscallError); ok && (se.Err == syscall.ENOENT || se.Err == syscall.ESRCH) {
+				return id, nil
+			}
+			return 0, fmt.Errorf("failed to query project %d: %v", id, err)
+		}
+		if q.curspace == 0 && q.curinodes == 0 && q.bhardlimit == 0 {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to find a free project ID for %q", dir)
+}
+
+// setProjectID assigns id to dir. If recursive is set it walks dir and assigns
+// id to every directory and regular file on the same filesystem, and marks
+// the directories so new files inherit the project ID.
+func setProjectID(dir string, id uint32, recursive bool) error {
+	if !recursive {
+		attr, err := getFsxattr(dir)
+		if err != nil {
+			return err
+		}
+		attr.projid = id
+		attr.xflags &^= fsXflagProjInherit
+		return setFsxattr(dir, attr)
+	}
+
+	var root syscall.Stat_t
+	if err := syscall.Stat(dir, &root); err != nil {
+		return err
+	}
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Don't descend into mounts such as the shared alloc dir or the
+		// secrets tmpfs.
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Dev != root.Dev {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		attr, err := getFsxattr(path)
+		if err != nil {
+			return err
+		}
+		attr.projid = id
+		if info.IsDir() {
+			attr.xflags |= fsXflagProjInherit
+		}
+		return setFsxattr(path, attr)
+	})
+}
+
+// quotaDevice returns the block device backing dir if it is on a filesystem
+// supporting project quotas with them enabled.
+func quotaDevice(dir string) (string, error) {
+	all, err := mounts()
+	if err != nil {
+		return "", err
+	}
+
+	// Find the longest mount point containing dir
+	var m mountInfo
+	for _, mi := range all {
+		if mi.MountPoint != "/" && dir != mi.MountPoint && !strings.HasPrefix(dir, mi.MountPoint+"/") {
+			continue
+		}
+		if len(mi.MountPoint) >= len(m.MountPoint) {
+			m = mi
+		}
+	}
+
+	if m.FSType != "xfs" && m.FSType != "ext4" {
+		return "", ErrQuotaUnsupported
+	}
+
+	// Project quotas must be enabled on the filesystem
+	var q dqblk
+	if err := quotactl(qGetQuota, m.Source, 0, &q); err != nil {
+		return "", ErrQuotaUnsupported
+	}
+	return m.Source, nil
+}
+
+func getFsxattr(path string) (*fsxattr, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var attr fsxattr
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFsGetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return nil, os.NewSyscallError("ioctl", errno)
+	}
+	return &attr, nil
+}
+
+func setFsxattr(path string, attr *fsxattr) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFsSetXattr, uintptr(unsafe.Pointer(attr))); errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
+
+// quotactl is a variable so tests can stub the results of quota queries.
+var quotactl = sysQuotactl
+
+func sysQuotactl(cmd int, dev string, id uint32, q *dqblk) error {
+	devPtr, err := syscall.BytePtrFromString(dev)
+	if err != nil {
+		return err
+	}
+
+	qcmd := cmd<<8 | prjQuota
+	if _, _, errno := syscall.Syscall6(syscall.SYS_QUOTACTL, uintptr(qcmd), uintptr(unsafe.Pointer(devPtr)),
+		uintptr(id), uintptr(unsafe.Pointer(q)), 0, 0); errno != 0 {
+		return os.NewSyscallError("quotactl", errno)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package allocdir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	cstructs "github.com/hashicorp/nomad/client/structs"
+	"golang.org/x/sys/unix"
+)
+
+// TestLinuxRootQuota asserts writes beyond the quota fail and the quota is
+// released on Destroy. It's skipped unless the temp dir is on a filesystem
+// with project quotas enabled.
+func TestLinuxRootQuota(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+	tmp, err := ioutil.TempDir("", "nomadtest-quota")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), tmp)
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	if err := d.SetQuota(1); err == ErrQuotaUnsupported {
+		t.Skip("Project quotas not supported")
+	} else if err != nil {
+		t.Fatalf("SetQuota() failed: %v", err)
+	}
+
+	// Setting it again should be a noop
+	if err := d.SetQuota(1); err != nil {
+		t.Fatalf("SetQuota() failed: %v", err)
+	}
+
+	// Writing more than the quota should fail
+	data := bytes.Repeat([]byte{'a'}, 2*1024*1024)
+	p := filepath.Join(d.SharedDir, SharedDataDir, "big")
+	if err := ioutil.WriteFile(p, data, 0666); err == nil {
+		t.Fatalf("expected writing beyond the quota to fail")
+	}
+
+	if err := d.Destroy(); err != nil {
+		t.Fatalf("Destroy() failed: %v", err)
+	}
+}
+
+// TestLinuxRootQuota_Chroot asserts a chroot embedded in a task dir is
+// hardlinked rather than copied and isn't charged to the quota while the
+// task's local dir is.
+func TestLinuxRootQuota_Chroot(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+	tmp, err := ioutil.TempDir("", "nomadtest-quota")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// Create a host dir larger than the quota on the same filesystem so it
+	// can only be embedded by hardlinking
+	src := filepath.Join(tmp, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatalf("Mkdir() failed: %v", err)
+	}
+	data := bytes.Repeat([]byte{'a'}, 2*1024*1024)
+	if err := ioutil.WriteFile(filepath.Join(src, "big"), data, 0644); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+
+	d := NewAllocDir(testLogger(), filepath.Join(tmp, "alloc"))
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	defer d.Destroy()
+
+	if err := d.SetQuota(1); err == ErrQuotaUnsupported {
+		t.Skip("Project quotas not supported")
+	} else if err != nil {
+		t.Fatalf("SetQuota() failed: %v", err)
+	}
+
+	td := d.NewTaskDir("task")
+	if err := td.Build(false, map[string]string{src: "/src"}, cstructs.FSIsolationChroot); err != nil {
+		t.Fatalf("TaskDir.Build() failed: %v", err)
+	}
+
+	var host, embedded syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(src, "big"), &host); err != nil {
+		t.Fatalf("Stat() failed: %v", err)
+	}
+	if err := syscall.Stat(filepath.Join(td.Dir, "src", "big"), &embedded); err != nil {
+		t.Fatalf("Stat() failed: %v", err)
+	}
+	if host.Ino != embedded.Ino {
+		t.Fatalf("expected chroot entry to be hardlinked")
+	}
+
+	// Writing more than the quota to the local dir should fail
+	if err := ioutil.WriteFile(filepath.Join(td.LocalDir, "big"), data, 0666); err == nil {
+		t.Fatalf("expected writing beyond the quota to fail")
+	}
+}
+
+// TestLinuxRootQuota_Overlay asserts writes to a chroot built with overlays
+// are charged to the quota.
+func TestLinuxRootQuota_Overlay(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+	if !overlaySupported() {
+		t.Skip("Overlay filesystem not supported")
+	}
+	tmp, err := ioutil.TempDir("", "nomadtest-quota")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatalf("Mkdir() failed: %v", err)
+	}
+
+	d := NewAllocDir(testLogger(), filepath.Join(tmp, "alloc"))
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	defer d.Destroy()
+
+	if err := d.SetQuota(1); err == ErrQuotaUnsupported {
+		t.Skip("Project quotas not supported")
+	} else if err != nil {
+		t.Fatalf("SetQuota() failed: %v", err)
+	}
+
+	td := d.NewTaskDir("task")
+	td.ChrootStrategy = ChrootStrategyOverlay
+	if err := td.Build(false, map[string]string{src: "/src"}, cstructs.FSIsolationChroot); err != nil {
+		t.Fatalf("TaskDir.Build() failed: %v", err)
+	}
+
+	// Writing more than the quota to the chroot should fail
+	data := bytes.Repeat([]byte{'a'}, 2*1024*1024)
+	if err := ioutil.WriteFile(filepath.Join(td.Dir, "src", "big"), data, 0666); err == nil {
+		t.Fatalf("expected writing beyond the quota to fail")
+	}
+}
+
+// TestLinuxQuota_FreeProjectID asserts project IDs reported as missing, as XFS
+// does for IDs that were never used, are considered free while other query
+// errors fail.
+func TestLinuxQuota_FreeProjectID(t *testing.T) {
+	defer func(f func(int, string, uint32, *dqblk) error) { quotactl = f }(quotactl)
+
+	var queried []uint32
+	quotactl = func(cmd int, dev string, id uint32, q *dqblk) error {
+		queried = append(queried, id)
+		if len(queried) == 1 {
+			// The first ID probed is in use
+			q.curspace = 1024
+			return nil
+		}
+		return os.NewSyscallError("quotactl", syscall.ENOENT)
+	}
+	id, err := freeProjectID("/dev/foo", "/alloc")
+	if err != nil {
+		t.Fatalf("freeProjectID() failed: %v", err)
+	}
+	if len(queried) != 2 || id != queried[1] {
+		t.Fatalf("expected the second ID probed to be free; got %d after probing %v", id, queried)
+	}
+
+	quotactl = func(cmd int, dev string, id uint32, q *dqblk) error {
+		return os.NewSyscallError("quotactl", syscall.ESRCH)
+	}
+	if _, err := freeProjectID("/dev/foo", "/alloc"); err != nil {
+		t.Fatalf("freeProjectID() failed: %v", err)
+	}
+
+	quotactl = func(cmd int, dev string, id uint32, q *dqblk) error {
+		return os.NewSyscallError("quotactl", syscall.EPERM)
+	}
+	if _, err := freeProjectID("/dev/foo", "/alloc"); err == nil {
+		t.Fatalf("expected an error querying projects")
+	}
+}
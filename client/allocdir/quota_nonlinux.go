@@ -0,0 +1,18 @@
+// +build !linux
+
+package allocdir
+
+// setQuota is currently unsupported on non-Linux platforms
+func setQuota(dir string, subdirs []string, sizeMB int) error {
+	return ErrQuotaUnsupported
+}
+
+// inheritQuota is currently a noop on non-Linux platforms
+func inheritQuota(dir string, dirs []string) error {
+	return nil
+}
+
+// removeQuota is currently a noop on non-Linux platforms
+func removeQuota(dir string) error {
+	return nil
+}
@@ -0,0 +1,84 @@
+package allocdir
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// selinuxXattr is the extended attribute holding a file's SELinux context
+	selinuxXattr = "security.selinux"
+
+	// selinuxEnforce exists when selinuxfs is mounted
+	selinuxEnforce = "/sys/fs/selinux/enforce"
+)
+
+// selinuxEnabled returns whether SELinux is enabled on the host.
+func selinuxEnabled() bool {
+	return pathExists(selinuxEnforce)
+}
+
+// setLabel sets the SELinux context of path. Nothing is done if label is empty
+// or SELinux isn't enabled.
+func setLabel(path, label string) error {
+	if label == "" || !selinuxEnabled() {
+		return nil
+	}
+	return labelFile(path, label)
+}
+
+// relabel recursively sets the SELinux context of dir and everything beneath
+// it on the same filesystem, similar to the :Z option of bind mounts in
+// container runtimes. Nothing is done if label is empty or SELinux isn't
+// enabled.
+func relabel(dir, label string) error {
+	if label == "" || !selinuxEnabled() {
+		return nil
+	}
+
+	var root syscall.Stat_t
+	if err := syscall.Lstat(dir, &root); err != nil {
+		return err
+	}
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Don't descend into other mounts such as the shared alloc dir
+		// mounted into a task dir.
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Dev != root.Dev {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Labeling a symlink would label its target
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return labelFile(path, label)
+	})
+}
+
+// labelFile sets the SELinux context of path if it differs.
+func labelFile(path, label string) error {
+	buf := make([]byte, 256)
+	if n, err := unix.Getxattr(path, selinuxXattr, buf); err == nil && n <= len(buf) {
+		// The stored context may be NUL terminated
+		if string(bytes.TrimRight(buf[:n], "\x00")) == label {
+			return nil
+		}
+	}
+
+	if err := unix.Setxattr(path, selinuxXattr, []byte(label), 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package allocdir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestLinuxRootSELinux asserts the shared dir is relabeled. It relabels with
+// the temp dir's current context so it is valid under the loaded policy.
+func TestLinuxRootSELinux(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+	if !selinuxEnabled() {
+		t.Skip("SELinux not enabled")
+	}
+
+	tmp, err := ioutil.TempDir("", "nomadtest-selinux")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	buf := make([]byte, 256)
+	n, err := unix.Getxattr(tmp, selinuxXattr, buf)
+	if err != nil {
+		t.Fatalf("error reading context of %q: %v", tmp, err)
+	}
+	label := string(bytes.TrimRight(buf[:n], "\x00"))
+
+	d := NewAllocDir(testLogger(), tmp)
+	d.SELinuxLabel = label
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	data := filepath.Join(d.SharedDir, SharedDataDir)
+	n, err = unix.Getxattr(data, selinuxXattr, buf)
+	if err != nil {
+		t.Fatalf("error reading context of %q: %v", data, err)
+	}
+	if actual := string(bytes.TrimRight(buf[:n], "\x00")); actual != label {
+		t.Fatalf("expected %q to be labeled %q; got %q", data, label, actual)
+	}
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package allocdir
+
+// currently a noop on non-Linux platforms
+func setLabel(path, label string) error {
+	return nil
+}
+
+// currently a noop on non-Linux platforms
+func relabel(dir, label string) error {
+	return nil
+}
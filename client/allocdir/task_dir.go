@@ -10,6 +10,50 @@ import (
 	cstructs "github.com/hashicorp/nomad/client/structs"
 )
 
+const (
+	// ChrootStrategyCopy embeds chroot entries in the task dir by hardlinking
+	// or copying them.
+	ChrootStrategyCopy = "copy"
+
+	// ChrootStrategyOverlay mounts an overlay filesystem for each chroot
+	// directory with the host directory as the read-only layer. Entries are
+	// copied instead if the kernel doesn't support overlays.
+	ChrootStrategyOverlay = "overlay"
+
+	// overlayDir is the directory in the alloc dir holding the writable
+	// layers of the tasks' chroot overlays. It's kept outside of the task
+	// dirs so tasks can't see the layers.
+	overlayDir = ".nomad-overlay"
+
+	// MountPropagationPrivate prevents mounts from propagating between the
+	// host's shared alloc dir and the task's view of it, including mounts
+	// beneath existing submounts.
+	MountPropagationPrivate = "private"
+
+	// MountPropagationSlave propagates mounts created beneath the shared
+	// alloc dir on the host into the task but not the other way.
+	MountPropagationSlave = "rslave"
+
+	// MountPropagationShared propagates mounts beneath the shared alloc dir
+	// in both directions.
+	MountPropagationShared = "rshared"
+)
+
+// SpecialDirs is a request for special filesystems to be mounted into a chroot
+// in addition to /dev and /proc which are always mounted.
+type SpecialDirs struct {
+	// Sys mounts a read-only sysfs at /sys
+	Sys bool
+
+	// DevPts mounts a new devpts instance at /dev/pts so the task can
+	// allocate pseudo terminals.
+	DevPts bool
+
+	// ShmSizeMB mounts a tmpfs of the given size in MBs at /dev/shm. If zero
+	// no tmpfs is mounted.
+	ShmSizeMB int
+}
+
 // TaskDir contains all of the paths relevant to a task. All paths are on the
 // host system so drivers should mount/link into task containers as necessary.
 type TaskDir struct {
@@ -37,6 +81,36 @@ type TaskDir struct {
 	// <task_dir>/secrets/
 	SecretsDir string
 
+	// OverlayDir is the path to the directory holding the writable layers of
+	// the task's chroot overlays on the host
+	// <alloc_dir>/.nomad-overlay/<task>/
+	OverlayDir string
+
+	// SecretsDirSize is the size in MBs of the tmpfs backing SecretsDir on
+	// platforms that support it. If zero a default size is used.
+	SecretsDirSize int
+
+	// ChrootStrategy controls how the chroot is built when chroot filesystem
+	// isolation is used. Defaults to ChrootStrategyCopy.
+	ChrootStrategy string
+
+	// MountPropagation is the propagation of the shared alloc dir mounted
+	// into the task dir with chroot filesystem isolation. If empty the mount
+	// inherits the propagation of the alloc dir's mount.
+	MountPropagation string
+
+	// SELinuxLabel is the SELinux context the task dir is labeled with on
+	// hosts with SELinux enabled. If empty the dir isn't labeled.
+	SELinuxLabel string
+
+	// User is the host user the task runs as. If set the directories the
+	// task writes to are owned by the user. See ChownToUser.
+	User string
+
+	// SpecialDirs are the special filesystems mounted into the chroot on
+	// platforms that support it, in addition to /dev and /proc.
+	SpecialDirs SpecialDirs
+
 	logger *log.Logger
 }
 
@@ -53,6 +127,7 @@ func newTaskDir(logger *log.Logger, allocDir, taskName string) *TaskDir {
 		SharedTaskDir:  filepath.Join(taskDir, SharedAllocName),
 		LocalDir:       filepath.Join(taskDir, TaskLocal),
 		SecretsDir:     filepath.Join(taskDir, TaskSecrets),
+		OverlayDir:     filepath.Join(allocDir, overlayDir, taskName),
 		logger:         logger,
 	}
 }
@@ -102,11 +177,14 @@ func (t *TaskDir) Build(chrootCreated bool, chroot map[string]string, fsi cstruc
 			if err := linkDir(t.SharedAllocDir, t.SharedTaskDir); err != nil {
 				return fmt.Errorf("Failed to mount shared directory for task: %v", err)
 			}
+			if err := setMountPropagation(t.SharedTaskDir, t.MountPropagation); err != nil {
+				return fmt.Errorf("Failed to set propagation of shared directory for task: %v", err)
+			}
 		}
 	}
 
 	// Create the secret directory
-	if err := createSecretDir(t.SecretsDir); err != nil {
+	if err := createSecretDir(t.SecretsDir, t.SecretsDirSize); err != nil {
 		return err
 	}
 
@@ -114,6 +192,32 @@ func (t *TaskDir) Build(chrootCreated bool, chroot map[string]string, fsi cstruc
 		return err
 	}
 
+	// Label the directories tasks may mount. The chroot is left as is.
+	if err := setLabel(t.Dir, t.SELinuxLabel); err != nil {
+		return fmt.Errorf("Failed to label task directory: %v", err)
+	}
+	for _, dir := range t.writableDirs() {
+		if err := relabel(dir, t.SELinuxLabel); err != nil {
+			return fmt.Errorf("Failed to label task directory: %v", err)
+		}
+	}
+
+	if t.User != "" {
+		if err := chownPaths(t.Dir, t.writableDirs(), t.User, false); err != nil {
+			return fmt.Errorf("Failed to change owner of task directory to %q: %v", t.User, err)
+		}
+	}
+
+	// Charge the directories the task writes to to the alloc dir's quota.
+	// The secrets dir is a tmpfs so only counts against its own size.
+	quotaDirs := []string{t.LocalDir}
+	for _, dir := range TaskDirs {
+		quotaDirs = append(quotaDirs, filepath.Join(t.Dir, dir))
+	}
+	if err := inheritQuota(filepath.Dir(t.Dir), quotaDirs); err != nil {
+		return err
+	}
+
 	// Build chroot if chroot filesystem isolation is going to be used
 	if fsi == cstructs.FSIsolationChroot {
 		if err := t.buildChroot(chrootCreated, chroot); err != nil {
@@ -124,13 +228,46 @@ func (t *TaskDir) Build(chrootCreated bool, chroot map[string]string, fsi cstruc
 	return nil
 }
 
+// ChownToUser changes the owner of the given paths in the task dir, and
+// everything in them, to User. This lets a task running as a non-root user
+// write to files created by Nomad such as artifacts and templates. Files with
+// more than one link and symlinked paths are skipped. Nothing is done if User
+// is empty or Nomad isn't running as root.
+func (t *TaskDir) ChownToUser(paths ...string) error {
+	if t.User == "" {
+		return nil
+	}
+	if err := chownPaths(t.Dir, paths, t.User, true); err != nil {
+		return fmt.Errorf("Failed to change owner of task directory to %q: %v", t.User, err)
+	}
+	return nil
+}
+
+// writableDirs returns the directories in the task dir the task writes to.
+func (t *TaskDir) writableDirs() []string {
+	dirs := []string{t.LocalDir, t.SecretsDir}
+	for _, dir := range TaskDirs {
+		dirs = append(dirs, filepath.Join(t.Dir, dir))
+	}
+	return dirs
+}
+
 // buildChroot takes a mapping of absolute directory or file paths on the host
 // to their intended, relative location within the task directory. This
 // attempts hardlink and then defaults to copying. If the path exists on the
 // host and can't be embedded an error is returned. If chrootCreated is true
 // skip expensive embedding operations and only ephemeral operations (eg
-// mounting /dev) are done.
+// mounting /dev) are done. With the overlay strategy directories are
+// overlaid rather than embedded.
 func (t *TaskDir) buildChroot(chrootCreated bool, entries map[string]string) error {
+	if t.ChrootStrategy == ChrootStrategyOverlay {
+		remaining, err := t.mountOverlays(entries)
+		if err != nil {
+			return err
+		}
+		entries = remaining
+	}
+
 	if !chrootCreated {
 		// Link/copy chroot entries
 		if err := t.embedDirs(entries); err != nil {
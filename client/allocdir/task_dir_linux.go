@@ -2,8 +2,12 @@ package allocdir
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
 
 	"github.com/hashicorp/go-multierror"
@@ -46,15 +50,72 @@ func (t *TaskDir) mountSpecialDirs() error {
 		}
 	}
 
+	// Mount the additional special dirs requested
+	if t.SpecialDirs.Sys {
+		sys := filepath.Join(t.Dir, "sys")
+		flags := uintptr(syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+		if err := mountSpecialDir(sys, "sysfs", flags, ""); err != nil {
+			return err
+		}
+	}
+	if t.SpecialDirs.DevPts {
+		pts := filepath.Join(dev, "pts")
+		flags := uintptr(syscall.MS_NOSUID | syscall.MS_NOEXEC)
+		if err := mountSpecialDir(pts, "devpts", flags, "newinstance,ptmxmode=0666,mode=0620"); err != nil {
+			return err
+		}
+	}
+	if t.SpecialDirs.ShmSizeMB > 0 {
+		shm := filepath.Join(dev, "shm")
+		flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+		options := fmt.Sprintf("size=%dm,mode=1777", t.SpecialDirs.ShmSizeMB)
+		if err := mountSpecialDir(shm, "tmpfs", flags, options); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mountSpecialDir mounts a filesystem of the given type at dir unless one is
+// already mounted there. The directory is created if it doesn't exist.
+func mountSpecialDir(dir, fstype string, flags uintptr, options string) error {
+	if mounted, err := isMountPoint(dir); err != nil {
+		return err
+	} else if mounted {
+		return nil
+	}
+
+	if !pathExists(dir) {
+		if err := os.Mkdir(dir, 0777); err != nil {
+			return fmt.Errorf("Mkdir(%v) failed: %v", dir, err)
+		}
+	}
+	if err := syscall.Mount("none", dir, fstype, flags, options); err != nil {
+		return fmt.Errorf("Couldn't mount %s to %v: %v", fstype, dir, err)
+	}
 	return nil
 }
 
-// unmountSpecialDirs unmounts the dev and proc file system from the chroot. No
-// error is returned if the directories do not exist or have already been
-// unmounted.
+// unmountSpecialDirs unmounts the dev and proc file system and any additional
+// special dirs from the chroot. No error is returned if the directories do not
+// exist or have already been unmounted.
 func (t *TaskDir) unmountSpecialDirs() error {
 	errs := new(multierror.Error)
 	dev := filepath.Join(t.Dir, "dev")
+
+	// Unmount the dirs mounted inside dev first. They're checked regardless
+	// of the request in case it changed.
+	for _, dir := range []string{filepath.Join(dev, "pts"), filepath.Join(dev, "shm")} {
+		if mounted, err := isMountPoint(dir); err != nil {
+			errs = multierror.Append(errs, err)
+		} else if mounted {
+			if err := unlinkDir(dir); err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("Failed to unmount %q: %v", dir, err))
+			}
+		}
+	}
+
 	if pathExists(dev) {
 		if err := unlinkDir(dev); err != nil {
 			errs = multierror.Append(errs, fmt.Errorf("Failed to unmount dev %q: %v", dev, err))
@@ -73,5 +134,171 @@ func (t *TaskDir) unmountSpecialDirs() error {
 		}
 	}
 
+	// Unmount sys.
+	sys := filepath.Join(t.Dir, "sys")
+	if pathExists(sys) {
+		if err := unlinkDir(sys); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("Failed to unmount sys %q: %v", sys, err))
+		} else if err := os.RemoveAll(sys); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("Failed to delete sys directory %q: %v", sys, err))
+		}
+	}
+
 	return errs.ErrorOrNil()
 }
+
+// mountOverlays mounts an overlay filesystem for each directory in entries
+// with the host directory as the lower layer and a writable layer in
+// OverlayDir, which is charged to the alloc dir's quota if one is set. Entries
+// are mounted in order of their destination so nested
+// entries are mounted on top of their parents. Directories already mounted
+// are skipped. The entries that weren't overlaid, such as files or all
+// entries if the kernel doesn't support overlays, are returned so they can be
+// embedded instead.
+func (t *TaskDir) mountOverlays(entries map[string]string) (map[string]string, error) {
+	if !overlaySupported() {
+		t.logger.Printf("[DEBUG] client: overlay filesystem not supported; embedding chroot for %q", t.Dir)
+		return entries, nil
+	}
+
+	mounted, err := t.overlayMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort the entries by destination so parents are mounted first
+	sources := make([]string, 0, len(entries))
+	for source := range entries {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return filepath.Clean(entries[sources[i]]) < filepath.Clean(entries[sources[j]])
+	})
+
+	remaining := make(map[string]string)
+	for _, source := range sources {
+		dest := entries[source]
+		s, err := os.Stat(source)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		// Overlay options can't contain these characters
+		if err != nil || !s.IsDir() || strings.ContainsAny(source, ",:") {
+			remaining[source] = dest
+			continue
+		}
+
+		destDir := filepath.Join(t.Dir, dest)
+		if _, ok := mounted[destDir]; ok {
+			continue
+		}
+
+		if err := createDir(t.Dir, dest); err != nil {
+			return nil, fmt.Errorf("Couldn't create destination directory %v: %v", destDir, err)
+		}
+
+		// Escape the destination so each gets its own layer
+		layer := filepath.Join(t.OverlayDir, url.PathEscape(filepath.Clean("/"+dest)))
+		upper := filepath.Join(layer, "upper")
+		work := filepath.Join(layer, "work")
+		if err := os.MkdirAll(upper, 0755); err != nil {
+			return nil, fmt.Errorf("Mkdir(%v) failed: %v", upper, err)
+		}
+		if err := os.MkdirAll(work, 0755); err != nil {
+			return nil, fmt.Errorf("Mkdir(%v) failed: %v", work, err)
+		}
+
+		// Files the task writes to its chroot end up in the writable layer
+		// so it's charged to the alloc dir's quota.
+		if err := inheritQuota(filepath.Dir(t.Dir), []string{upper, work}); err != nil {
+			return nil, err
+		}
+
+		options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", source, upper, work)
+		if err := syscall.Mount("overlay", destDir, "overlay", 0, options); err != nil {
+			t.logger.Printf("[WARN] client: failed to mount overlay of %q at %q, embedding instead: %v", source, destDir, err)
+			remaining[source] = dest
+		}
+	}
+
+	return remaining, nil
+}
+
+// unmountOverlays unmounts the overlay filesystems in the task dir. No error
+// is returned if none are mounted.
+func (t *TaskDir) unmountOverlays() error {
+	mounted, err := t.overlayMounts()
+	if err != nil {
+		return err
+	}
+
+	// Unmount nested mounts first
+	paths := make([]string, 0, len(mounted))
+	for path := range mounted {
+		paths = append(paths, path)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	errs := new(multierror.Error)
+	for _, path := range paths {
+		if err := unlinkDir(path); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("Failed to unmount overlay %q: %v", path, err))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// overlayMounts returns the set of overlay filesystems mounted in the task dir
+func (t *TaskDir) overlayMounts() (map[string]struct{}, error) {
+	all, err := mounts()
+	if err != nil {
+		return nil, err
+	}
+
+	mounted := make(map[string]struct{})
+	for _, m := range all {
+		if m.FSType == "overlay" && strings.HasPrefix(m.MountPoint, t.Dir+"/") {
+			mounted[m.MountPoint] = struct{}{}
+		}
+	}
+	return mounted, nil
+}
+
+// overlaySupported returns whether the kernel supports overlay filesystems
+func overlaySupported() bool {
+	data, err := ioutil.ReadFile("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == "overlay" {
+			return true
+		}
+	}
+	return false
+}
+
+// setMountPropagation changes the propagation of the mount at dir and its
+// submounts. An empty mode leaves the propagation unchanged.
+func setMountPropagation(dir, mode string) error {
+	var flags uintptr
+	switch mode {
+	case "":
+		return nil
+	case MountPropagationPrivate:
+		flags = syscall.MS_PRIVATE | syscall.MS_REC
+	case MountPropagationSlave:
+		flags = syscall.MS_SLAVE | syscall.MS_REC
+	case MountPropagationShared:
+		flags = syscall.MS_SHARED | syscall.MS_REC
+	default:
+		return fmt.Errorf("unknown mount propagation %q", mode)
+	}
+
+	if err := syscall.Mount("", dir, "", flags, ""); err != nil {
+		return os.NewSyscallError("mount", err)
+	}
+	return nil
+}
@@ -1,11 +1,15 @@
 package allocdir
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/user"
 	"path/filepath"
+	"syscall"
 	"testing"
 
+	cstructs "github.com/hashicorp/nomad/client/structs"
 	"golang.org/x/sys/unix"
 )
 
@@ -70,3 +74,317 @@ func TestLinuxSpecialDirs(t *testing.T) {
 		t.Fatalf("error re-unmounting special dirs in %q: %v", td.Dir, err)
 	}
 }
+
+// TestLinuxExtraSpecialDirs ensures mounting the additional special dirs
+// requested works.
+func TestLinuxExtraSpecialDirs(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+
+	allocDir, err := ioutil.TempDir("", "nomadtest-specialdirs")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(allocDir)
+
+	td := newTaskDir(testLogger(), allocDir, "test")
+	td.SpecialDirs = SpecialDirs{
+		Sys:       true,
+		DevPts:    true,
+		ShmSizeMB: 1,
+	}
+	if err := os.MkdirAll(td.Dir, 0777); err != nil {
+		t.Fatalf("error creating task dir %q: %v", td.Dir, err)
+	}
+	defer td.unmountSpecialDirs()
+
+	if err := td.mountSpecialDirs(); err != nil {
+		t.Fatalf("error mounting special dirs in %q: %v", td.Dir, err)
+	}
+
+	// Remounting again should be fine
+	if err := td.mountSpecialDirs(); err != nil {
+		t.Fatalf("error remounting special dirs in %q: %v", td.Dir, err)
+	}
+
+	dirs := []string{
+		filepath.Join(td.Dir, "sys"),
+		filepath.Join(td.Dir, "dev", "pts"),
+		filepath.Join(td.Dir, "dev", "shm"),
+	}
+	for _, dir := range dirs {
+		if mounted, err := isMountPoint(dir); err != nil || !mounted {
+			t.Fatalf("expected %q to be mounted: %v", dir, err)
+		}
+	}
+
+	if err := td.unmountSpecialDirs(); err != nil {
+		t.Fatalf("error unmounting special dirs in %q: %v", td.Dir, err)
+	}
+	for _, dir := range dirs {
+		if mounted, err := isMountPoint(dir); err != nil || mounted {
+			t.Fatalf("expected %q to be unmounted: %v", dir, err)
+		}
+	}
+	if pathExists(filepath.Join(td.Dir, "sys")) {
+		t.Fatalf("sys was not removed from %q", td.Dir)
+	}
+}
+
+// TestLinuxOverlays ensures chroot directories can be overlaid and writes
+// don't reach the host directory.
+func TestLinuxOverlays(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+	if !overlaySupported() {
+		t.Skip("Overlay filesystem not supported")
+	}
+
+	allocDir, err := ioutil.TempDir("", "nomadtest-overlays")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(allocDir)
+
+	source, err := ioutil.TempDir("", "nomadtest-overlays-source")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(source)
+	if err := ioutil.WriteFile(filepath.Join(source, "foo"), []byte("foo"), 0666); err != nil {
+		t.Fatalf("error writing source file: %v", err)
+	}
+
+	// Nested entries and entries whose names only differ by a separator
+	// should each get their own layer
+	nested, err := ioutil.TempDir("", "nomadtest-overlays-nested")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(nested)
+	if err := ioutil.WriteFile(filepath.Join(nested, "baz"), []byte("baz"), 0666); err != nil {
+		t.Fatalf("error writing source file: %v", err)
+	}
+
+	td := newTaskDir(testLogger(), allocDir, "test")
+	if err := os.MkdirAll(td.Dir, 0777); err != nil {
+		t.Fatalf("error creating task dir %q: %v", td.Dir, err)
+	}
+
+	entries := map[string]string{
+		source: "/src",
+		nested: "/src/nested",
+		"/bin": "/src-nested",
+	}
+	remaining, err := td.mountOverlays(entries)
+	if err != nil {
+		t.Fatalf("error mounting overlays in %q: %v", td.Dir, err)
+	}
+	defer td.unmountOverlays()
+	if len(remaining) != 0 {
+		t.Fatalf("expected all entries to be overlaid; remaining: %v", remaining)
+	}
+	if _, err := os.Stat(filepath.Join(td.Dir, "src", "nested", "baz")); err != nil {
+		t.Fatalf("expected nested overlay to be mounted on top of its parent: %v", err)
+	}
+	if pathExists(filepath.Join(td.Dir, overlayDir)) {
+		t.Fatalf("overlay layers are visible in the task dir %q", td.Dir)
+	}
+	if layers, err := ioutil.ReadDir(td.OverlayDir); err != nil || len(layers) != len(entries) {
+		t.Fatalf("expected %d layers in %q: %v %v", len(entries), td.OverlayDir, layers, err)
+	}
+
+	// Mounting again should be a noop
+	if _, err := td.mountOverlays(entries); err != nil {
+		t.Fatalf("error remounting overlays in %q: %v", td.Dir, err)
+	}
+
+	dest := filepath.Join(td.Dir, "src")
+	if _, err := os.Stat(filepath.Join(dest, "foo")); err != nil {
+		t.Fatalf("expected overlaid file to exist: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dest, "bar"), []byte("bar"), 0666); err != nil {
+		t.Fatalf("error writing to overlay: %v", err)
+	}
+	if pathExists(filepath.Join(source, "bar")) {
+		t.Fatalf("write to overlay reached the host directory")
+	}
+
+	if err := td.unmountOverlays(); err != nil {
+		t.Fatalf("error unmounting overlays in %q: %v", td.Dir, err)
+	}
+	if pathExists(filepath.Join(dest, "foo")) {
+		t.Fatalf("overlay was not unmounted from %q", dest)
+	}
+	if err := td.unmountOverlays(); err != nil {
+		t.Fatalf("error re-unmounting overlays in %q: %v", td.Dir, err)
+	}
+}
+
+// TestLinuxMountPropagation asserts mounts created in the shared alloc dir
+// after it is linked into the task dir are visible with slave propagation and
+// not with private propagation.
+func TestLinuxMountPropagation(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+
+	tmp, err := ioutil.TempDir("", "nomadtest-propagation")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// Make the source a shared mount so it has mounts to propagate
+	src := filepath.Join(tmp, "alloc")
+	if err := linkDir(src, src); err != nil {
+		t.Fatalf("error mounting %q: %v", src, err)
+	}
+	defer unlinkDir(src)
+	if err := setMountPropagation(src, MountPropagationShared); err != nil {
+		t.Fatalf("error setting propagation of %q: %v", src, err)
+	}
+
+	dst := filepath.Join(tmp, "task", "alloc")
+	if err := linkDir(src, dst); err != nil {
+		t.Fatalf("error linking %q: %v", dst, err)
+	}
+	defer unlinkDir(dst)
+	if err := setMountPropagation(dst, MountPropagationSlave); err != nil {
+		t.Fatalf("error setting propagation of %q: %v", dst, err)
+	}
+
+	data := filepath.Join(src, "data")
+	if err := os.Mkdir(data, 0777); err != nil {
+		t.Fatalf("error creating %q: %v", data, err)
+	}
+	if err := unix.Mount("tmpfs", data, "tmpfs", 0, ""); err != nil {
+		t.Fatalf("error mounting %q: %v", data, err)
+	}
+	defer unlinkDir(data)
+	defer unlinkDir(filepath.Join(dst, "data"))
+
+	mounted, err := isMountPoint(filepath.Join(dst, "data"))
+	if err != nil {
+		t.Fatalf("error listing mounts: %v", err)
+	}
+	if !mounted {
+		t.Fatalf("expected mount to propagate into the task dir")
+	}
+
+	// Private propagation also applies to the submounts of the task's view
+	// so mounts beneath them stop propagating too
+	if err := setMountPropagation(dst, MountPropagationPrivate); err != nil {
+		t.Fatalf("error setting propagation of %q: %v", dst, err)
+	}
+	inner := filepath.Join(data, "inner")
+	if err := os.Mkdir(inner, 0777); err != nil {
+		t.Fatalf("error creating %q: %v", inner, err)
+	}
+	if err := unix.Mount("tmpfs", inner, "tmpfs", 0, ""); err != nil {
+		t.Fatalf("error mounting %q: %v", inner, err)
+	}
+	defer unlinkDir(inner)
+	defer unlinkDir(filepath.Join(dst, "data", "inner"))
+
+	mounted, err = isMountPoint(filepath.Join(dst, "data", "inner"))
+	if err != nil {
+		t.Fatalf("error listing mounts: %v", err)
+	}
+	if mounted {
+		t.Fatalf("expected mount not to propagate into the task dir")
+	}
+
+	if err := setMountPropagation(dst, "bogus"); err == nil {
+		t.Fatalf("expected an error for an unknown propagation")
+	}
+}
+
+// Test that the directories a task writes to are owned by the task user.
+func TestLinuxRootChownToUser(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("nobody user not found: %v", err)
+	}
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), tmp)
+	defer d.Destroy()
+	td := d.NewTaskDir(t1.Name)
+	td.User = u.Username
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	if err := td.Build(false, nil, cstructs.FSIsolationImage); err != nil {
+		t.Fatalf("TaskDir.Build failed: %v", err)
+	}
+
+	// Files created by Nomad after the task dir is built are root owned
+	// until their owner is changed
+	artifact := filepath.Join(td.LocalDir, "artifact")
+	if err := os.MkdirAll(filepath.Join(artifact, "bin"), 0755); err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	file := filepath.Join(artifact, "bin", "foo")
+	if err := ioutil.WriteFile(file, []byte("foo"), 0644); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+
+	// Files the task links to from elsewhere must be left alone
+	host := filepath.Join(tmp, "host")
+	if err := ioutil.WriteFile(host, []byte("host"), 0644); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := os.Link(host, filepath.Join(artifact, "hardlink")); err != nil {
+		t.Fatalf("Couldn't link file: %v", err)
+	}
+	if err := os.Symlink(tmp, filepath.Join(td.LocalDir, "symlink")); err != nil {
+		t.Fatalf("Couldn't link file: %v", err)
+	}
+	other := filepath.Join(td.LocalDir, "other")
+	if err := ioutil.WriteFile(other, []byte("other"), 0644); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+
+	if err := td.ChownToUser(artifact, filepath.Join(td.LocalDir, "symlink", "host")); err != nil {
+		t.Fatalf("ChownToUser failed: %v", err)
+	}
+	if err := td.ChownToUser(filepath.Join(tmp, "host")); err == nil {
+		t.Fatalf("expected an error for a path outside the task dir")
+	}
+
+	owner := func(path string) string {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return fmt.Sprint(fi.Sys().(*syscall.Stat_t).Uid)
+	}
+	for _, path := range []string{td.LocalDir, td.SecretsDir, artifact, file} {
+		if uid := owner(path); uid != u.Uid {
+			t.Fatalf("expected %q to be owned by %s; got %s", path, u.Uid, uid)
+		}
+	}
+	for _, path := range []string{host, other, filepath.Join(td.LocalDir, "symlink")} {
+		if uid := owner(path); uid != "0" {
+			t.Fatalf("expected %q to be owned by root; got %s", path, uid)
+		}
+	}
+
+	// Rebuilding the task dir only changes the owner of the dirs themselves
+	if err := td.Build(true, nil, cstructs.FSIsolationImage); err != nil {
+		t.Fatalf("TaskDir.Build failed: %v", err)
+	}
+	if uid := owner(other); uid != "0" {
+		t.Fatalf("expected %q to be owned by root; got %s", other, uid)
+	}
+}
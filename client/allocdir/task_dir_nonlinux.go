@@ -11,3 +11,18 @@ func (d *TaskDir) mountSpecialDirs() error {
 func (d *TaskDir) unmountSpecialDirs() error {
 	return nil
 }
+
+// currently a noop on non-Linux platforms so all entries are embedded
+func (d *TaskDir) mountOverlays(entries map[string]string) (map[string]string, error) {
+	return entries, nil
+}
+
+// currently a noop on non-Linux platforms
+func (d *TaskDir) unmountOverlays() error {
+	return nil
+}
+
+// currently a noop on non-Linux platforms as directories aren't bind mounted
+func setMountPropagation(dir, mode string) error {
+	return nil
+}
@@ -1,13 +1,15 @@
 package client
 
 import (
-	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -83,8 +85,28 @@ const (
 	// allocSyncRetryIntv is the interval on which we retry updating
 	// the status of the allocation
 	allocSyncRetryIntv = 5 * time.Second
+
+	// snapshotRetryIntv is the minimum interval on which we retry
+	// downloading the snapshot of a remote alloc dir
+	snapshotRetryIntv = 5 * time.Second
+
+	// snapshotMaxAttempts is the number of times downloading the snapshot
+	// of a remote alloc dir is attempted before giving up
+	snapshotMaxAttempts = 5
+
+	// busyMountsIntv is how often the client checks whether mounts in alloc
+	// dirs that couldn't be unmounted are still in use.
+	busyMountsIntv = 1 * time.Minute
+
+	// busyMountsAttr is the node attribute listing the mounts in alloc dirs
+	// that couldn't be unmounted because they are still in use.
+	busyMountsAttr = "unique.alloc_dir.busy_mounts"
 )
 
+// errMigrationStopped is returned when migrating a remote alloc dir is stopped
+// because it's no longer needed or the client is shutting down.
+var errMigrationStopped = errors.New("migration stopped")
+
 // ClientStatsReporter exposes all the APIs related to resource usage of a Nomad
 // Client
 type ClientStatsReporter interface {
@@ -235,11 +257,13 @@ func NewClient(cfg *config.Config, consulSyncer *consul.Syncer, logger *log.Logg
 
 	// Add the garbage collector
 	gcConfig := &GCConfig{
-		DiskUsageThreshold:  cfg.GCDiskUsageThreshold,
-		InodeUsageThreshold: cfg.GCInodeUsageThreshold,
-		Interval:            cfg.GCInterval,
-		ParallelDestroys:    cfg.GCParallelDestroys,
-		ReservedDiskMB:      cfg.Node.Reserved.DiskMB,
+		DiskUsageThreshold:     cfg.GCDiskUsageThreshold,
+		InodeUsageThreshold:    cfg.GCInodeUsageThreshold,
+		DiskUsageLowWatermark:  cfg.GCDiskUsageLowWatermark,
+		InodeUsageLowWatermark: cfg.GCInodeUsageLowWatermark,
+		Interval:               cfg.GCInterval,
+		ParallelDestroys:       cfg.GCParallelDestroys,
+		ReservedDiskMB:         cfg.Node.Reserved.DiskMB,
 	}
 	c.garbageCollector = NewAllocGarbageCollector(logger, statsCollector, gcConfig)
 
@@ -933,6 +957,9 @@ func (c *Client) registerAndHeartbeat() {
 	// Start watching changes for node changes
 	go c.watchNodeUpdates()
 
+	// Report mounts that couldn't be unmounted in the node's attributes
+	go c.watchBusyMounts()
+
 	// Setup the heartbeat timer, for the initial registration
 	// we want to do this quickly. We want to do it extra quickly
 	// in development mode.
@@ -1447,6 +1474,40 @@ func (c *Client) watchNodeUpdates() {
 	}
 }
 
+// watchBusyMounts periodically reflects the mounts in alloc dirs that couldn't
+// be unmounted because they're still in use in the node's attributes, along
+// with the PIDs holding them. The attribute is removed once they're released.
+// Changes are sent to the servers by watchNodeUpdates.
+func (c *Client) watchBusyMounts() {
+	for {
+		select {
+		case <-time.After(busyMountsIntv):
+			c.updateBusyMounts()
+		case <-c.shutdownCh:
+			return
+		}
+	}
+}
+
+// updateBusyMounts sets the busy mounts node attribute.
+func (c *Client) updateBusyMounts() {
+	busy := allocdir.BusyMounts()
+	metrics.SetGauge([]string{"client", "mounts", "held"}, float32(len(busy)))
+
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
+	if len(busy) == 0 {
+		delete(c.config.Node.Attributes, busyMountsAttr)
+		return
+	}
+
+	desc := strings.Join(busy, "; ")
+	if c.config.Node.Attributes[busyMountsAttr] != desc {
+		c.logger.Printf("[WARN] client: mounts in alloc dirs are still in use: %s", desc)
+	}
+	c.config.Node.Attributes[busyMountsAttr] = desc
+}
+
 // runAllocs is invoked when we get an updated set of allocations
 func (c *Client) runAllocs(update *allocUpdates) {
 	// Get the existing allocs
@@ -1683,7 +1744,7 @@ func (c *Client) migrateRemoteAllocDir(alloc *structs.Allocation, allocID string
 	if node.TLSEnabled {
 		scheme = "https"
 	}
-	// Create an API client
+	// Create an HTTP client configured to talk to the remote node
 	apiConfig := nomadapi.DefaultConfig()
 	apiConfig.Address = fmt.Sprintf("%s://%s", scheme, node.HTTPAddr)
 	apiConfig.TLSConfig = &nomadapi.TLSConfig{
@@ -1691,19 +1752,30 @@ func (c *Client) migrateRemoteAllocDir(alloc *structs.Allocation, allocID string
 		ClientCert: c.config.TLSConfig.CertFile,
 		ClientKey:  c.config.TLSConfig.KeyFile,
 	}
-	apiClient, err := nomadapi.NewClient(apiConfig)
-	if err != nil {
+	if err := apiConfig.ConfigureTLS(); err != nil {
 		return nil, err
 	}
 
-	url := fmt.Sprintf("/v1/client/allocation/%v/snapshot", alloc.ID)
-	resp, err := apiClient.Raw().Response(url, nil)
-	if err != nil {
+	// Download the snapshot to disk first so an interrupted transfer can be
+	// resumed and the snapshot verified before it is unpacked.
+	url := fmt.Sprintf("%s/v1/client/allocation/%v/snapshot?compress=gzip", apiConfig.Address, alloc.ID)
+	archive := pathToAllocDir + ".download"
+	defer os.Remove(archive)
+	if err := c.downloadAllocSnapshot(apiConfig.HttpClient, url, archive, allocID); err != nil {
 		os.RemoveAll(pathToAllocDir)
+		if err == errMigrationStopped {
+			c.logger.Printf("[INFO] client: stopping migration of allocdir for alloc: %v", allocID)
+			return nil, nil
+		}
 		c.logger.Printf("[ERR] client: error getting snapshot: %v", err)
 		return nil, fmt.Errorf("error getting snapshot for alloc %v: %v", alloc.ID, err)
 	}
 
+	resp, err := os.Open(archive)
+	if err != nil {
+		os.RemoveAll(pathToAllocDir)
+		return nil, fmt.Errorf("error opening snapshot for alloc %v: %v", alloc.ID, err)
+	}
 	if err := c.unarchiveAllocDir(resp, allocID, pathToAllocDir); err != nil {
 		return nil, err
 	}
@@ -1713,98 +1785,192 @@ func (c *Client) migrateRemoteAllocDir(alloc *structs.Allocation, allocID string
 	return prevAllocDir, nil
 }
 
-// unarchiveAllocDir reads the stream of a compressed allocation directory and
-// writes them to the disk.
-func (c *Client) unarchiveAllocDir(resp io.ReadCloser, allocID string, pathToAllocDir string) error {
-	tr := tar.NewReader(resp)
-	defer resp.Close()
-
-	buf := make([]byte, 1024)
-
+// downloadAllocSnapshot downloads the snapshot of a remote alloc dir to path.
+// Failed transfers are retried, resuming from where they stopped, and the
+// download is verified against the checksum sent as the snapshot's ETag.
+func (c *Client) downloadAllocSnapshot(httpClient *http.Client, url, path, allocID string) error {
+	c.migratingAllocsLock.Lock()
 	stopMigrating, ok := c.migratingAllocs[allocID]
+	c.migratingAllocsLock.Unlock()
 	if !ok {
-		os.RemoveAll(pathToAllocDir)
 		return fmt.Errorf("Allocation %q is not marked for remote migration", allocID)
 	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var etag string
+	var lastErr error
+	for attempt := 0; attempt < snapshotMaxAttempts; attempt++ {
+		if attempt > 0 {
+			c.logger.Printf("[WARN] client: retrying snapshot download for alloc %q: %v", allocID, lastErr)
+			select {
+			case <-time.After(c.retryIntv(snapshotRetryIntv)):
+			case <-stopMigrating.ch:
+				return errMigrationStopped
+			case <-c.shutdownCh:
+				return errMigrationStopped
+			}
+		}
+
+		etag, lastErr = c.fetchAllocSnapshot(httpClient, url, etag, f, stopMigrating)
+		if lastErr == errMigrationStopped {
+			return lastErr
+		}
+		if lastErr != nil {
+			continue
+		}
+
+		// Older servers don't send a checksum
+		if etag == "" {
+			return nil
+		}
+		if lastErr = verifySnapshot(f, etag); lastErr != nil {
+			// The download can't be trusted so start over
+			etag = ""
+			continue
+		}
+		return nil
+	}
+
+	return fmt.Errorf("failed after %d attempts: %v", snapshotMaxAttempts, lastErr)
+}
+
+// fetchAllocSnapshot writes the snapshot at url to f. If the snapshot's ETag
+// is known the transfer resumes from the end of f. The ETag of the snapshot
+// being written is returned so a failed transfer can be resumed.
+func (c *Client) fetchAllocSnapshot(httpClient *http.Client, url, etag string, f *os.File, stopMigrating *migrateAllocCtrl) (string, error) {
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if offset > 0 && etag != "" {
+		// If the snapshot changed the whole snapshot is sent instead
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", etag)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return etag, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// Discard anything already downloaded
+		if err := f.Truncate(0); err != nil {
+			return "", err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		etag = resp.Header.Get("ETag")
+	default:
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("unexpected response code: %d (%s)", resp.StatusCode, body)
+
+		// The range is invalid so request the whole snapshot next time
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return "", err
+		}
+		return etag, err
+	}
+
+	buf := make([]byte, 32*1024)
 	for {
 		// See if the alloc still needs migration
 		select {
 		case <-stopMigrating.ch:
-			os.RemoveAll(pathToAllocDir)
-			c.logger.Printf("[INFO] client: stopping migration of allocdir for alloc: %v", allocID)
-			return nil
+			return etag, errMigrationStopped
 		case <-c.shutdownCh:
-			os.RemoveAll(pathToAllocDir)
-			c.logger.Printf("[INFO] client: stopping migration of alloc %q since client is shutting down", allocID)
-			return nil
+			return etag, errMigrationStopped
 		default:
 		}
 
-		// Get the next header
-		hdr, err := tr.Next()
-
-		// Snapshot has ended
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := f.Write(buf[:n]); err != nil {
+				return etag, err
+			}
+		}
 		if err == io.EOF {
-			return nil
+			return etag, nil
 		}
-		// If there is an error then we avoid creating the alloc dir
 		if err != nil {
-			os.RemoveAll(pathToAllocDir)
-			return fmt.Errorf("error creating alloc dir for alloc %q: %v", allocID, err)
+			return etag, err
 		}
+	}
+}
 
-		// If the header is for a directory we create the directory
-		if hdr.Typeflag == tar.TypeDir {
-			os.MkdirAll(filepath.Join(pathToAllocDir, hdr.Name), os.FileMode(hdr.Mode))
-			continue
-		}
-		// If the header is a file, we write to a file
-		if hdr.Typeflag == tar.TypeReg {
-			f, err := os.Create(filepath.Join(pathToAllocDir, hdr.Name))
-			if err != nil {
-				c.logger.Printf("[ERR] client: error creating file: %v", err)
-				continue
-			}
+// verifySnapshot checks the contents of f match the checksum sent as the
+// snapshot's ETag.
+func verifySnapshot(f *os.File, etag string) error {
+	expected, err := strconv.Unquote(etag)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot checksum %q", etag)
+	}
 
-			// Setting the permissions of the file as the origin.
-			if err := f.Chmod(os.FileMode(hdr.Mode)); err != nil {
-				f.Close()
-				c.logger.Printf("[ERR] client: error chmod-ing file %s: %v", f.Name(), err)
-				return fmt.Errorf("error chmoding file %v", err)
-			}
-			if err := f.Chown(hdr.Uid, hdr.Gid); err != nil {
-				f.Close()
-				c.logger.Printf("[ERR] client: error chown-ing file %s: %v", f.Name(), err)
-				return fmt.Errorf("error chowning file %v", err)
-			}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("snapshot checksum mismatch: expected %s, got %s", expected, actual)
+	}
+	return nil
+}
 
-			// We write in chunks of 32 bytes so that we can test if
-			// the client is still alive
-			for {
-				if c.shutdown {
-					f.Close()
-					os.RemoveAll(pathToAllocDir)
-					c.logger.Printf("[INFO] client: stopping migration of alloc %q because client is shutting down", allocID)
-					return nil
-				}
+// unarchiveAllocDir reads the stream of a compressed allocation directory and
+// writes them to the disk.
+func (c *Client) unarchiveAllocDir(resp io.ReadCloser, allocID string, pathToAllocDir string) error {
+	defer resp.Close()
 
-				n, err := tr.Read(buf)
-				if err != nil {
-					f.Close()
-					if err != io.EOF {
-						return fmt.Errorf("error reading snapshot: %v", err)
-					}
-					break
-				}
-				if _, err := f.Write(buf[:n]); err != nil {
-					f.Close()
-					os.RemoveAll(pathToAllocDir)
-					return fmt.Errorf("error writing to file %q: %v", f.Name(), err)
-				}
-			}
+	c.migratingAllocsLock.Lock()
+	stopMigrating, ok := c.migratingAllocs[allocID]
+	c.migratingAllocsLock.Unlock()
+	if !ok {
+		os.RemoveAll(pathToAllocDir)
+		return fmt.Errorf("Allocation %q is not marked for remote migration", allocID)
+	}
+
+	// Stop restoring if the alloc no longer needs migration or the client is
+	// shutting down
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	go func() {
+		select {
+		case <-stopMigrating.ch:
+		case <-c.shutdownCh:
+		case <-doneCh:
+			return
+		}
+		close(stopCh)
+	}()
 
+	allocDir := allocdir.NewAllocDir(c.logger, pathToAllocDir)
+	if err := allocDir.Restore(resp, stopCh); err != nil {
+		os.RemoveAll(pathToAllocDir)
+		if err == allocdir.ErrRestoreStopped {
+			c.logger.Printf("[INFO] client: stopping migration of allocdir for alloc: %v", allocID)
+			return nil
 		}
+		return fmt.Errorf("error creating alloc dir for alloc %q: %v", allocID, err)
 	}
+	return nil
 }
 
 // getNode gets the node from the server with the given Node ID
@@ -3,14 +3,21 @@ package client
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -178,6 +185,21 @@ func TestClient_Fingerprint(t *testing.T) {
 	}
 }
 
+func TestClient_UpdateBusyMounts(t *testing.T) {
+	c := testClient(t, nil)
+	defer c.Shutdown()
+
+	// The attribute is removed once no mounts are held
+	c.configLock.Lock()
+	c.config.Node.Attributes[busyMountsAttr] = "mount \"/foo\" was busy"
+	c.configLock.Unlock()
+
+	c.updateBusyMounts()
+	if attr, ok := c.Node().Attributes[busyMountsAttr]; ok {
+		t.Fatalf("expected busy mounts attribute to be removed; got %q", attr)
+	}
+}
+
 func TestClient_HasNodeChanged(t *testing.T) {
 	c := testClient(t, nil)
 	defer c.Shutdown()
@@ -1027,3 +1049,87 @@ func TestClient_UnarchiveAllocDir(t *testing.T) {
 		t.Fatalf("mode: %v", fi1.Mode())
 	}
 }
+
+func TestClient_DownloadAllocSnapshot_Resume(t *testing.T) {
+	data := bytes.Repeat([]byte("nomad"), 4096)
+	sum := sha256.Sum256(data)
+	etag := strconv.Quote(hex.EncodeToString(sum[:]))
+
+	// Fail the first request half way through the snapshot
+	var requests []*http.Request
+	var requestsLock sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsLock.Lock()
+		requests = append(requests, r)
+		n := len(requests)
+		requestsLock.Unlock()
+
+		w.Header().Set("ETag", etag)
+		if n == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data[:len(data)/2])
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c1 := testClient(t, func(c *config.Config) {
+		c.RPCHandler = nil
+	})
+	defer c1.Shutdown()
+
+	c1.migratingAllocs["123"] = newMigrateAllocCtrl(mock.Alloc())
+	path := filepath.Join(dir, "snapshot")
+	if err := c1.downloadAllocSnapshot(http.DefaultClient, ts.URL, path, "123"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	requestsLock.Lock()
+	defer requestsLock.Unlock()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests; got %d", len(requests))
+	}
+	if r := requests[1].Header.Get("Range"); r != fmt.Sprintf("bytes=%d-", len(data)/2) {
+		t.Fatalf("expected transfer to resume; got range %q", r)
+	}
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("downloaded snapshot doesn't match")
+	}
+}
+
+func TestClient_DownloadAllocSnapshot_BadChecksum(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", strconv.Quote("bad"))
+		w.Write([]byte("foo"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c1 := testClient(t, func(c *config.Config) {
+		c.RPCHandler = nil
+	})
+	defer c1.Shutdown()
+
+	c1.migratingAllocs["123"] = newMigrateAllocCtrl(mock.Alloc())
+	err = c1.downloadAllocSnapshot(http.DefaultClient, ts.URL, filepath.Join(dir, "snapshot"), "123")
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch; got %v", err)
+	}
+}
@@ -96,6 +96,14 @@ type Config struct {
 	// used.
 	MaxKillTimeout time.Duration
 
+	// SecretsDirSize is the default size in MBs of the tmpfs mounted as each
+	// task's secrets directory.
+	SecretsDirSize int
+
+	// MaxSecretsDirSize is the maximum size in MBs a task may request for its
+	// secrets directory.
+	MaxSecretsDirSize int
+
 	// Servers is a list of known server addresses. These are as "host:port"
 	Servers []string
 
@@ -171,6 +179,16 @@ type Config struct {
 	// beyond which the Nomad client triggers GC of the terminal allocations
 	GCInodeUsageThreshold float64
 
+	// GCDiskUsageLowWatermark is the disk usage percent the Nomad client
+	// garbage collects terminal allocations down to once the disk usage
+	// threshold has been crossed. It defaults to GCDiskUsageThreshold.
+	GCDiskUsageLowWatermark float64
+
+	// GCInodeUsageLowWatermark is the inode usage percent the Nomad client
+	// garbage collects terminal allocations down to once the inode usage
+	// threshold has been crossed. It defaults to GCInodeUsageThreshold.
+	GCInodeUsageLowWatermark float64
+
 	// LogLevel is the level of the logs to putout
 	LogLevel string
 
@@ -205,6 +223,8 @@ func DefaultConfig() *Config {
 		GCParallelDestroys:      2,
 		GCDiskUsageThreshold:    80,
 		GCInodeUsageThreshold:   70,
+		SecretsDirSize:          1,
+		MaxSecretsDirSize:       64,
 	}
 }
 
@@ -191,6 +191,19 @@ type Driver interface {
 type DriverAbilities struct {
 	// SendSignals marks the driver as being able to send signals
 	SendSignals bool
+
+	// MountPropagation is the propagation the shared alloc dir is mounted
+	// into the task dir with when the driver uses chroot isolation. Drivers
+	// that need mounts created after the task starts, such as volumes, to be
+	// visible inside the task should request allocdir.MountPropagationSlave
+	// or allocdir.MountPropagationShared. If empty the mount's propagation
+	// is left unchanged.
+	MountPropagation string
+
+	// SpecialDirs are the special filesystems, in addition to /dev and
+	// /proc, mounted into the task dir when the driver uses chroot
+	// isolation.
+	SpecialDirs allocdir.SpecialDirs
 }
 
 // LogEventFn is a callback which allows Drivers to emit task events.
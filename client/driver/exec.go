@@ -85,6 +85,10 @@ func (d *ExecDriver) Validate(config map[string]interface{}) error {
 func (d *ExecDriver) Abilities() DriverAbilities {
 	return DriverAbilities{
 		SendSignals: true,
+
+		// Volumes mounted in the shared alloc dir after the task started
+		// should be visible to it without its mounts leaking to the host.
+		MountPropagation: allocdir.MountPropagationSlave,
 	}
 }
 
@@ -20,9 +20,16 @@ const (
 type GCConfig struct {
 	DiskUsageThreshold  float64
 	InodeUsageThreshold float64
-	Interval            time.Duration
-	ReservedDiskMB      int
-	ParallelDestroys    int
+
+	// DiskUsageLowWatermark and InodeUsageLowWatermark are the usage percents
+	// the collector brings usage down to once a threshold has been crossed.
+	// They default to the thresholds.
+	DiskUsageLowWatermark  float64
+	InodeUsageLowWatermark float64
+
+	Interval         time.Duration
+	ReservedDiskMB   int
+	ParallelDestroys int
 }
 
 // AllocGarbageCollector garbage collects terminated allocations on a node
@@ -44,6 +51,22 @@ func NewAllocGarbageCollector(logger *log.Logger, statsCollector stats.NodeStats
 		config.ParallelDestroys = 1
 	}
 
+	// The low watermarks can't be above the thresholds
+	if config.DiskUsageLowWatermark <= 0 {
+		config.DiskUsageLowWatermark = config.DiskUsageThreshold
+	} else if config.DiskUsageLowWatermark > config.DiskUsageThreshold {
+		logger.Printf("[WARN] client: garbage collector disk usage low watermark %v is above the threshold; using %v",
+			config.DiskUsageLowWatermark, config.DiskUsageThreshold)
+		config.DiskUsageLowWatermark = config.DiskUsageThreshold
+	}
+	if config.InodeUsageLowWatermark <= 0 {
+		config.InodeUsageLowWatermark = config.InodeUsageThreshold
+	} else if config.InodeUsageLowWatermark > config.InodeUsageThreshold {
+		logger.Printf("[WARN] client: garbage collector inode usage low watermark %v is above the threshold; using %v",
+			config.InodeUsageLowWatermark, config.InodeUsageThreshold)
+		config.InodeUsageLowWatermark = config.InodeUsageThreshold
+	}
+
 	gc := &AllocGarbageCollector{
 		allocRunners:   NewIndexedGCAllocPQ(),
 		statsCollector: statsCollector,
@@ -73,8 +96,13 @@ func (a *AllocGarbageCollector) run() {
 }
 
 // keepUsageBelowThreshold collects disk usage information and garbage collects
-// allocations to make disk space available.
+// allocations to make disk space available. Once the disk or inode usage
+// crosses its threshold the oldest terminal allocations are collected until
+// both are below their low watermarks so collection isn't triggered again on
+// every interval.
 func (a *AllocGarbageCollector) keepUsageBelowThreshold() error {
+	diskLimit := a.config.DiskUsageThreshold
+	inodeLimit := a.config.InodeUsageThreshold
 	for {
 		select {
 		case <-a.shutdownCh:
@@ -100,11 +128,16 @@ func (a *AllocGarbageCollector) keepUsageBelowThreshold() error {
 			break
 		}
 
-		if diskStats.UsedPercent <= a.config.DiskUsageThreshold &&
-			diskStats.InodesUsedPercent <= a.config.InodeUsageThreshold {
+		if diskStats.UsedPercent <= diskLimit &&
+			diskStats.InodesUsedPercent <= inodeLimit {
 			break
 		}
 
+		// A threshold was crossed so keep collecting until the usage drops
+		// below the low watermarks
+		diskLimit = a.config.DiskUsageLowWatermark
+		inodeLimit = a.config.InodeUsageLowWatermark
+
 		// Collect an allocation
 		gcAlloc := a.allocRunners.Pop()
 		if gcAlloc == nil {
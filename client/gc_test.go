@@ -363,3 +363,53 @@ func TestAllocGarbageCollector_UsedPercentThreshold(t *testing.T) {
 		t.Fatalf("gcAlloc: %v", gcAlloc)
 	}
 }
+
+func TestAllocGarbageCollector_UsedPercentLowWatermark(t *testing.T) {
+	logger := log.New(os.Stdout, "", 0)
+	statsCollector := &MockStatsCollector{}
+	conf := gcConfig
+	conf.DiskUsageLowWatermark = 50
+	gc := NewAllocGarbageCollector(logger, statsCollector, &conf)
+
+	for i := 0; i < 3; i++ {
+		_, ar := testAllocRunnerFromAlloc(mock.Alloc(), false)
+		close(ar.waitCh)
+		if err := gc.MarkForCollection(ar); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	statsCollector.availableValues = []uint64{1000, 1200, 1400}
+	statsCollector.usedPercents = []float64{85, 60, 40}
+	statsCollector.inodePercents = []float64{50, 30, 20}
+
+	if err := gc.keepUsageBelowThreshold(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// We should be GC-ing two of the alloc runners since the second time used
+	// percent is below the threshold but still above the low watermark.
+	if gcAlloc := gc.allocRunners.Pop(); gcAlloc == nil {
+		t.Fatalf("err: %v", gcAlloc)
+	}
+
+	if gcAlloc := gc.allocRunners.Pop(); gcAlloc != nil {
+		t.Fatalf("gcAlloc: %v", gcAlloc)
+	}
+}
+
+func TestAllocGarbageCollector_LowWatermarkDefault(t *testing.T) {
+	logger := log.New(os.Stdout, "", 0)
+	conf := gcConfig
+	conf.DiskUsageLowWatermark = 0
+	conf.InodeUsageLowWatermark = 95
+	gc := NewAllocGarbageCollector(logger, &MockStatsCollector{}, &conf)
+	defer gc.Stop()
+
+	if gc.config.DiskUsageLowWatermark != conf.DiskUsageThreshold {
+		t.Fatalf("bad disk low watermark: %v", gc.config.DiskUsageLowWatermark)
+	}
+	if gc.config.InodeUsageLowWatermark != conf.InodeUsageThreshold {
+		t.Fatalf("bad inode low watermark: %v", gc.config.InodeUsageLowWatermark)
+	}
+}
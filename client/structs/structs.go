@@ -74,10 +74,29 @@ type AllocResourceUsage struct {
 	// Tasks contains the resource usage of each task
 	Tasks map[string]*TaskResourceUsage
 
+	// DiskUsage is the disk usage of the allocation directory
+	DiskUsage *DiskUsage
+
 	// The max timestamp of all the Tasks
 	Timestamp int64
 }
 
+// DiskUsage holds the measured disk usage of an allocation directory
+type DiskUsage struct {
+	// UsedBytes is the disk space used by the allocation directory
+	UsedBytes uint64
+
+	// LimitMB is the disk space requested by the allocation. Zero means no
+	// limit.
+	LimitMB int
+
+	// Exceeded is set if UsedBytes is greater than LimitMB
+	Exceeded bool
+
+	// Timestamp is when the usage was measured
+	Timestamp int64
+}
+
 // joinStringSet takes two slices of strings and joins them
 func joinStringSet(s1, s2 []string) []string {
 	lookup := make(map[string]struct{}, len(s1))
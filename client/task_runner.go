@@ -422,6 +422,15 @@ func (r *TaskRunner) Run() {
 	// Build base task directory structure regardless of FS isolation abilities.
 	// This needs to happen before we start the Vault manager and call prestart
 	// as both those can write to the task directories
+	abilities := drv.Abilities()
+	r.taskDir.MountPropagation = abilities.MountPropagation
+	r.taskDir.SpecialDirs = abilities.SpecialDirs
+
+	// Tasks not isolated by an image run as a host user which should own
+	// the directories the task writes to.
+	if drv.FSIsolation() != cstructs.FSIsolationImage {
+		r.taskDir.User = r.task.User
+	}
 	if err := r.buildTaskDir(drv.FSIsolation()); err != nil {
 		e := fmt.Errorf("failed to build task directory for %q: %v", r.task.Name, err)
 		r.setState(
@@ -789,6 +798,14 @@ func (r *TaskRunner) prestart(resultCh chan bool) {
 			return
 		}
 
+		if err := r.taskDir.ChownToUser(renderTo); err != nil {
+			r.setState(
+				structs.TaskStateDead,
+				structs.NewTaskEvent(structs.TaskSetupFailure).SetSetupError(err).SetFailsTask())
+			resultCh <- false
+			return
+		}
+
 		r.payloadRendered = true
 	}
 
@@ -800,6 +817,7 @@ func (r *TaskRunner) prestart(resultCh chan bool) {
 		// Download the task's artifacts
 		if !downloaded && len(r.task.Artifacts) > 0 {
 			r.setState(structs.TaskStatePending, structs.NewTaskEvent(structs.TaskDownloadingArtifacts))
+			dests := make([]string, 0, len(r.task.Artifacts))
 			for _, artifact := range r.task.Artifacts {
 				if err := getter.GetArtifact(r.getTaskEnv(), artifact, r.taskDir.Dir); err != nil {
 					wrapped := fmt.Errorf("failed to download artifact %q: %v", artifact.GetterSource, err)
@@ -809,6 +827,16 @@ func (r *TaskRunner) prestart(resultCh chan bool) {
 					r.restartTracker.SetStartError(structs.WrapRecoverable(wrapped.Error(), err))
 					goto RESTART
 				}
+				dests = append(dests, filepath.Join(r.taskDir.Dir, artifact.RelativeDest))
+			}
+
+			// Give the task user ownership of the downloaded artifacts
+			if err := r.taskDir.ChownToUser(dests...); err != nil {
+				r.setState(
+					structs.TaskStateDead,
+					structs.NewTaskEvent(structs.TaskSetupFailure).SetSetupError(err).SetFailsTask())
+				resultCh <- false
+				return
 			}
 
 			r.persistLock.Lock()
@@ -1191,6 +1219,20 @@ func (r *TaskRunner) startTask() error {
 			r.task.Name, r.alloc.ID, err)
 	}
 
+	// Give the task user ownership of the rendered templates. Only the
+	// rendered files are changed as the rest of the task dir may have been
+	// written to by the task.
+	if len(r.task.Templates) != 0 {
+		taskEnv := r.getTaskEnv()
+		dests := make([]string, 0, len(r.task.Templates))
+		for _, tmpl := range r.task.Templates {
+			dests = append(dests, filepath.Join(r.taskDir.Dir, taskEnv.ReplaceEnv(tmpl.DestPath)))
+		}
+		if err := r.taskDir.ChownToUser(dests...); err != nil {
+			return err
+		}
+	}
+
 	// Run prestart
 	ctx := driver.NewExecContext(r.taskDir)
 	res, err := drv.Prestart(ctx, r.task)
@@ -1242,6 +1284,30 @@ func (r *TaskRunner) buildTaskDir(fsi cstructs.FSIsolation) error {
 	if len(r.config.ChrootEnv) > 0 {
 		chroot = r.config.ChrootEnv
 	}
+
+	// Size the secrets dir using the task's request if set, otherwise the
+	// client's default.
+	secretsSize := r.config.SecretsDirSize
+	if r.task.SecretsDirSizeMB != 0 {
+		secretsSize = r.task.SecretsDirSizeMB
+	}
+	if max := r.config.MaxSecretsDirSize; max != 0 && secretsSize > max {
+		return fmt.Errorf("secrets dir size of %d MB exceeds the client maximum of %d MB", secretsSize, max)
+	}
+	r.taskDir.SecretsDirSize = secretsSize
+
+	// Host files can't be hardlinked into an alloc dir backed by an image so
+	// overlay the chroot rather than copying it into the image
+	defaultStrategy := allocdir.ChrootStrategyCopy
+	if r.config.ReadBoolDefault("alloc_dir.image.enable", false) {
+		defaultStrategy = allocdir.ChrootStrategyOverlay
+	}
+	strategy := r.config.ReadDefault("alloc_dir.chroot.strategy", defaultStrategy)
+	if strategy != allocdir.ChrootStrategyCopy && strategy != allocdir.ChrootStrategyOverlay {
+		return fmt.Errorf("unknown chroot strategy %q", strategy)
+	}
+	r.taskDir.ChrootStrategy = strategy
+
 	if err := r.taskDir.Build(built, chroot, fsi); err != nil {
 		return err
 	}
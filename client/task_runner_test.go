@@ -1472,3 +1472,35 @@ func TestTaskRunner_CleanupFail(t *testing.T) {
 		t.Fatalf("expected %#v but found: %#v", expected, ctx.tr.createdResources.Resources)
 	}
 }
+
+func TestTaskRunner_SecretsDirSize(t *testing.T) {
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	task.Driver = "mock_driver"
+
+	ctx := testTaskRunnerFromAlloc(t, false, alloc)
+	defer ctx.Cleanup()
+
+	// The client default is used when the task doesn't ask for a size
+	if err := ctx.tr.buildTaskDir(cstructs.FSIsolationNone); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if size := ctx.tr.taskDir.SecretsDirSize; size != ctx.tr.config.SecretsDirSize {
+		t.Fatalf("expected default secrets dir size %d; got %d", ctx.tr.config.SecretsDirSize, size)
+	}
+
+	// A task request above the client maximum is rejected
+	ctx.tr.task.SecretsDirSizeMB = ctx.tr.config.MaxSecretsDirSize + 1
+	if err := ctx.tr.buildTaskDir(cstructs.FSIsolationNone); err == nil {
+		t.Fatalf("expected error when exceeding the maximum secrets dir size")
+	}
+
+	// A task request within the maximum is honored
+	ctx.tr.task.SecretsDirSizeMB = ctx.tr.config.MaxSecretsDirSize
+	if err := ctx.tr.buildTaskDir(cstructs.FSIsolationNone); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if size := ctx.tr.taskDir.SecretsDirSize; size != ctx.tr.config.MaxSecretsDirSize {
+		t.Fatalf("expected secrets dir size %d; got %d", ctx.tr.config.MaxSecretsDirSize, size)
+	}
+}
@@ -269,6 +269,16 @@ func (a *Agent) clientConfig() (*clientconfig.Config, error) {
 		}
 		conf.MaxKillTimeout = dur
 	}
+	if a.config.Client.SecretsDirSize != 0 {
+		conf.SecretsDirSize = a.config.Client.SecretsDirSize
+	}
+	if a.config.Client.MaxSecretsDirSize != 0 {
+		conf.MaxSecretsDirSize = a.config.Client.MaxSecretsDirSize
+	}
+	if conf.SecretsDirSize > conf.MaxSecretsDirSize {
+		return nil, fmt.Errorf("secrets_dir_size (%d) may not exceed max_secrets_dir_size (%d)",
+			conf.SecretsDirSize, conf.MaxSecretsDirSize)
+	}
 	conf.ClientMaxPort = uint(a.config.Client.ClientMaxPort)
 	conf.ClientMinPort = uint(a.config.Client.ClientMinPort)
 
@@ -316,6 +326,8 @@ func (a *Agent) clientConfig() (*clientconfig.Config, error) {
 	conf.GCParallelDestroys = a.config.Client.GCParallelDestroys
 	conf.GCDiskUsageThreshold = a.config.Client.GCDiskUsageThreshold
 	conf.GCInodeUsageThreshold = a.config.Client.GCInodeUsageThreshold
+	conf.GCDiskUsageLowWatermark = a.config.Client.GCDiskUsageLowWatermark
+	conf.GCInodeUsageLowWatermark = a.config.Client.GCInodeUsageLowWatermark
 	conf.NoHostUUID = a.config.Client.NoHostUUID
 
 	return conf, nil
@@ -2,7 +2,9 @@ package agent
 
 import (
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/golang/snappy"
@@ -115,12 +117,64 @@ func (s *HTTPServer) allocSnapshot(allocID string, resp http.ResponseWriter, req
 	if err != nil {
 		return nil, fmt.Errorf(allocNotFoundErr)
 	}
-	if err := allocFS.Snapshot(resp); err != nil {
+
+	// Clients that don't request a compressed archive expect a tar stream
+	if req.URL.Query().Get("compress") != "gzip" {
+		if err := allocFS.Snapshot(resp); err != nil {
+			return nil, fmt.Errorf("error making snapshot: %v", err)
+		}
+		return nil, nil
+	}
+
+	// A ranged request resumes a transfer so the previous archive is served
+	refresh := req.Header.Get("Range") == ""
+	archive, checksum, err := allocFS.SnapshotArchive(refresh)
+	if err != nil {
 		return nil, fmt.Errorf("error making snapshot: %v", err)
 	}
+	defer archive.Close()
+
+	fi, err := archive.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error making snapshot: %v", err)
+	}
+
+	// The ETag lets clients verify the archive and resume with If-Range
+	resp.Header().Set("Content-Type", "application/gzip")
+	resp.Header().Set("ETag", strconv.Quote(checksum))
+	content := &offsetReadSeeker{ReadSeeker: archive}
+	http.ServeContent(resp, req, "", fi.ModTime(), content)
+
+	// The archive is kept after an interrupted transfer so it can be
+	// resumed. Once the end has been sent it's no longer needed.
+	if content.offset >= fi.Size() {
+		if err := allocFS.ReleaseSnapshotArchive(checksum); err != nil {
+			s.logger.Printf("[WARN] http: failed to remove snapshot archive of alloc %q: %v", allocID, err)
+		}
+	}
 	return nil, nil
 }
 
+// offsetReadSeeker tracks the offset of the last byte read from a ReadSeeker
+type offsetReadSeeker struct {
+	io.ReadSeeker
+	offset int64
+}
+
+func (o *offsetReadSeeker) Read(p []byte) (int, error) {
+	n, err := o.ReadSeeker.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *offsetReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	n, err := o.ReadSeeker.Seek(offset, whence)
+	if err == nil {
+		o.offset = n
+	}
+	return n, err
+}
+
 func (s *HTTPServer) allocStats(allocID string, resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	clientStats := s.agent.client.StatsReporter()
 	aStats, err := clientStats.GetAllocStats(allocID)
@@ -50,6 +50,8 @@ client {
 	client_min_port = 1000
 	client_max_port = 2000
     max_kill_timeout = "10s"
+    secrets_dir_size = 2
+    max_secrets_dir_size = 32
     stats {
         data_points = 35
         collection_interval = "5s"
@@ -58,6 +60,8 @@ client {
     gc_parallel_destroys = 6
     gc_disk_usage_threshold = 82
     gc_inode_usage_threshold = 91
+    gc_disk_usage_low_watermark = 72
+    gc_inode_usage_low_watermark = 81
     no_host_uuid = true
 }
 server {
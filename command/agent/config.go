@@ -188,6 +188,13 @@ type ClientConfig struct {
 	// MaxKillTimeout allows capping the user-specifiable KillTimeout.
 	MaxKillTimeout string `mapstructure:"max_kill_timeout"`
 
+	// SecretsDirSize is the default size in MBs of each task's secrets
+	// directory.
+	SecretsDirSize int `mapstructure:"secrets_dir_size"`
+
+	// MaxSecretsDirSize caps the user-specifiable secrets directory size.
+	MaxSecretsDirSize int `mapstructure:"max_secrets_dir_size"`
+
 	// ClientMaxPort is the upper range of the ports that the client uses for
 	// communicating with plugin subsystems
 	ClientMaxPort int `mapstructure:"client_max_port"`
@@ -217,6 +224,14 @@ type ClientConfig struct {
 	// client triggers GC of the terminal allocations
 	GCInodeUsageThreshold float64 `mapstructure:"gc_inode_usage_threshold"`
 
+	// GCDiskUsageLowWatermark is the disk usage the Nomad client garbage
+	// collects terminal allocations down to once the threshold is crossed
+	GCDiskUsageLowWatermark float64 `mapstructure:"gc_disk_usage_low_watermark"`
+
+	// GCInodeUsageLowWatermark is the inode usage the Nomad client garbage
+	// collects terminal allocations down to once the threshold is crossed
+	GCInodeUsageLowWatermark float64 `mapstructure:"gc_inode_usage_low_watermark"`
+
 	// NoHostUUID disables using the host's UUID and will force generation of a
 	// random UUID.
 	NoHostUUID bool `mapstructure:"no_host_uuid"`
@@ -527,6 +542,8 @@ func DefaultConfig() *Config {
 		Client: &ClientConfig{
 			Enabled:               false,
 			MaxKillTimeout:        "30s",
+			SecretsDirSize:        1,
+			MaxSecretsDirSize:     64,
 			ClientMinPort:         14000,
 			ClientMaxPort:         14512,
 			Reserved:              &Resources{},
@@ -925,6 +942,12 @@ func (a *ClientConfig) Merge(b *ClientConfig) *ClientConfig {
 	if b.MaxKillTimeout != "" {
 		result.MaxKillTimeout = b.MaxKillTimeout
 	}
+	if b.SecretsDirSize != 0 {
+		result.SecretsDirSize = b.SecretsDirSize
+	}
+	if b.MaxSecretsDirSize != 0 {
+		result.MaxSecretsDirSize = b.MaxSecretsDirSize
+	}
 	if b.ClientMaxPort != 0 {
 		result.ClientMaxPort = b.ClientMaxPort
 	}
@@ -949,6 +972,12 @@ func (a *ClientConfig) Merge(b *ClientConfig) *ClientConfig {
 	if b.GCInodeUsageThreshold != 0 {
 		result.GCInodeUsageThreshold = b.GCInodeUsageThreshold
 	}
+	if b.GCDiskUsageLowWatermark != 0 {
+		result.GCDiskUsageLowWatermark = b.GCDiskUsageLowWatermark
+	}
+	if b.GCInodeUsageLowWatermark != 0 {
+		result.GCInodeUsageLowWatermark = b.GCInodeUsageLowWatermark
+	}
 	if b.NoHostUUID {
 		result.NoHostUUID = b.NoHostUUID
 	}
@@ -338,6 +338,8 @@ func parseClient(result **ClientConfig, list *ast.ObjectList) error {
 		"network_speed",
 		"cpu_total_compute",
 		"max_kill_timeout",
+		"secrets_dir_size",
+		"max_secrets_dir_size",
 		"client_max_port",
 		"client_min_port",
 		"reserved",
@@ -345,6 +347,8 @@ func parseClient(result **ClientConfig, list *ast.ObjectList) error {
 		"gc_interval",
 		"gc_disk_usage_threshold",
 		"gc_inode_usage_threshold",
+		"gc_disk_usage_low_watermark",
+		"gc_inode_usage_low_watermark",
 		"gc_parallel_destroys",
 		"no_host_uuid",
 	}
@@ -57,12 +57,14 @@ func TestConfig_Parse(t *testing.T) {
 						"/opt/myapp/etc": "/etc",
 						"/opt/myapp/bin": "/bin",
 					},
-					NetworkInterface: "eth0",
-					NetworkSpeed:     100,
-					CpuCompute:       4444,
-					MaxKillTimeout:   "10s",
-					ClientMinPort:    1000,
-					ClientMaxPort:    2000,
+					NetworkInterface:  "eth0",
+					NetworkSpeed:      100,
+					CpuCompute:        4444,
+					MaxKillTimeout:    "10s",
+					SecretsDirSize:    2,
+					MaxSecretsDirSize: 32,
+					ClientMinPort:     1000,
+					ClientMaxPort:     2000,
 					Reserved: &Resources{
 						CPU:                 10,
 						MemoryMB:            10,
@@ -71,11 +73,13 @@ func TestConfig_Parse(t *testing.T) {
 						ReservedPorts:       "1,100,10-12",
 						ParsedReservedPorts: []int{1, 10, 11, 12, 100},
 					},
-					GCInterval:            6 * time.Second,
-					GCParallelDestroys:    6,
-					GCDiskUsageThreshold:  82,
-					GCInodeUsageThreshold: 91,
-					NoHostUUID:            true,
+					GCInterval:               6 * time.Second,
+					GCParallelDestroys:       6,
+					GCDiskUsageThreshold:     82,
+					GCInodeUsageThreshold:    91,
+					GCDiskUsageLowWatermark:  72,
+					GCInodeUsageLowWatermark: 81,
+					NoHostUUID:               true,
 				},
 				Server: &ServerConfig{
 					Enabled:           true,
@@ -199,12 +199,14 @@ func TestConfig_Merge(t *testing.T) {
 				"foo": "bar",
 				"baz": "zip",
 			},
-			ChrootEnv:      map[string]string{},
-			ClientMaxPort:  20000,
-			ClientMinPort:  22000,
-			NetworkSpeed:   105,
-			CpuCompute:     105,
-			MaxKillTimeout: "50s",
+			ChrootEnv:         map[string]string{},
+			ClientMaxPort:     20000,
+			ClientMinPort:     22000,
+			NetworkSpeed:      105,
+			CpuCompute:        105,
+			MaxKillTimeout:    "50s",
+			SecretsDirSize:    3,
+			MaxSecretsDirSize: 48,
 			Reserved: &Resources{
 				CPU:                 15,
 				MemoryMB:            15,
@@ -213,10 +215,12 @@ func TestConfig_Merge(t *testing.T) {
 				ReservedPorts:       "2,10-30,55",
 				ParsedReservedPorts: []int{1, 2, 3},
 			},
-			GCInterval:            6 * time.Second,
-			GCParallelDestroys:    6,
-			GCDiskUsageThreshold:  71,
-			GCInodeUsageThreshold: 86,
+			GCInterval:               6 * time.Second,
+			GCParallelDestroys:       6,
+			GCDiskUsageThreshold:     71,
+			GCInodeUsageThreshold:    86,
+			GCDiskUsageLowWatermark:  61,
+			GCInodeUsageLowWatermark: 76,
 		},
 		Server: &ServerConfig{
 			Enabled:           true,
@@ -380,6 +380,12 @@ func (c *AllocStatusCommand) outputTaskStatus(state *api.TaskState) {
 			desc = event.DriverMessage
 		case api.TaskLeaderDead:
 			desc = "Leader Task in Group dead"
+		case api.TaskDiskExceeded:
+			if event.DiskLimit != 0 {
+				desc = fmt.Sprintf("Allocation exceeded its disk limit of %v", humanize.IBytes(uint64(event.DiskLimit)))
+			} else {
+				desc = "Allocation exceeded its disk limit"
+			}
 		}
 
 		// Reverse order so we are sorted by time
@@ -2,6 +2,7 @@ package jobspec
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -23,7 +24,9 @@ import (
 var reDynamicPorts = regexp.MustCompile("^[a-zA-Z0-9_]+$")
 var errPortLabel = fmt.Errorf("Port label does not conform to naming requirements %s", reDynamicPorts.String())
 
-// Parse parses the job spec from the given io.Reader.
+// Parse parses the job spec from the given io.Reader. Jobs in the JSON format
+// used by the HTTP API are detected and decoded as is, otherwise the job spec
+// is parsed as HCL.
 //
 // Due to current internal limitations, the entire contents of the
 // io.Reader will be copied into memory first before parsing.
@@ -34,6 +37,10 @@ func Parse(r io.Reader) (*api.Job, error) {
 		return nil, err
 	}
 
+	if job, ok, err := parseAPIJob(buf.Bytes()); ok {
+		return job, err
+	}
+
 	// Parse the buffer
 	root, err := hcl.Parse(buf.String())
 	if err != nil {
@@ -69,6 +76,43 @@ func Parse(r io.Reader) (*api.Job, error) {
 	return &job, nil
 }
 
+// parseAPIJob decodes a job in the JSON format of the HTTP API. Both a bare
+// job, as returned when reading a job, and a job wrapped in a "Job" object,
+// as output by `nomad inspect` and sent when registering a job, are accepted.
+// ok is false if the input isn't an API job so it can be parsed as HCL, which
+// also covers job specs written in HCL's JSON syntax.
+func parseAPIJob(b []byte) (job *api.Job, ok bool, err error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || b[0] != '{' {
+		return nil, false, nil
+	}
+
+	var root map[string]json.RawMessage
+	if err := json.Unmarshal(b, &root); err != nil {
+		return nil, false, nil
+	}
+
+	raw, wrapped := root["Job"]
+	if !wrapped {
+		// HCL's JSON syntax uses a lowercase "job" key so the API's field
+		// names identify a bare job.
+		_, hasID := root["ID"]
+		_, hasGroups := root["TaskGroups"]
+		if !hasID && !hasGroups {
+			return nil, false, nil
+		}
+		raw = b
+	}
+
+	if err := json.Unmarshal(raw, &job); err != nil {
+		return nil, true, fmt.Errorf("error parsing JSON job: %s", err)
+	}
+	if job == nil {
+		return nil, true, fmt.Errorf("error parsing JSON job: 'Job' is empty")
+	}
+	return job, true, nil
+}
+
 // ParseFile parses the given path as a job spec.
 func ParseFile(path string) (*api.Job, error) {
 	path, err := filepath.Abs(path)
@@ -576,6 +620,7 @@ func parseTasks(jobName string, taskGroupName string, result *[]*api.Task, list
 			"logs",
 			"meta",
 			"resources",
+			"secrets_dir_size",
 			"service",
 			"template",
 			"user",
@@ -135,7 +135,8 @@ func TestParse(t *testing.T) {
 										},
 									},
 								},
-								KillTimeout: helper.TimeToPtr(22 * time.Second),
+								KillTimeout:      helper.TimeToPtr(22 * time.Second),
+								SecretsDirSizeMB: 5,
 								LogConfig: &api.LogConfig{
 									MaxFiles:      helper.IntToPtr(14),
 									MaxFileSizeMB: helper.IntToPtr(101),
@@ -521,6 +522,78 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"api-job.json",
+			&api.Job{
+				ID:          helper.StringToPtr("example"),
+				Name:        helper.StringToPtr("example"),
+				Type:        helper.StringToPtr("service"),
+				Priority:    helper.IntToPtr(50),
+				Datacenters: []string{"dc1"},
+				Update: &api.UpdateStrategy{
+					Stagger:     10 * time.Second,
+					MaxParallel: 1,
+				},
+				TaskGroups: []*api.TaskGroup{
+					{
+						Name:  helper.StringToPtr("cache"),
+						Count: helper.IntToPtr(1),
+						Tasks: []*api.Task{
+							{
+								Name:   "redis",
+								Driver: "docker",
+								Config: map[string]interface{}{
+									"image": "redis:3.2",
+								},
+								Resources: &api.Resources{
+									CPU:      helper.IntToPtr(500),
+									MemoryMB: helper.IntToPtr(256),
+								},
+							},
+						},
+					},
+				},
+				Status:      helper.StringToPtr("running"),
+				CreateIndex: helper.Uint64ToPtr(10),
+				ModifyIndex: helper.Uint64ToPtr(12),
+			},
+			false,
+		},
+		{
+			"api-job-bare.json",
+			&api.Job{
+				ID:          helper.StringToPtr("example"),
+				Name:        helper.StringToPtr("example"),
+				Type:        helper.StringToPtr("batch"),
+				Datacenters: []string{"dc1"},
+				TaskGroups: []*api.TaskGroup{
+					{
+						Name: helper.StringToPtr("cache"),
+						Tasks: []*api.Task{
+							{
+								Name:   "redis",
+								Driver: "docker",
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"hcl-job.json",
+			&api.Job{
+				ID:          helper.StringToPtr("example"),
+				Name:        helper.StringToPtr("example"),
+				Datacenters: []string{"dc1"},
+			},
+			false,
+		},
+		{
+			"bad-api-job.json",
+			nil,
+			true,
+		},
 	}
 
 	for _, tc := range cases {
@@ -114,6 +114,7 @@ job "binstore-storagelocker" {
       }
 
       kill_timeout = "22s"
+      secrets_dir_size = 5
 
       artifact {
         source = "http://foo.com/artifact"
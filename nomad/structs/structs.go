@@ -2364,6 +2364,10 @@ type Task struct {
 	// LogConfig provides configuration for log rotation
 	LogConfig *LogConfig
 
+	// SecretsDirSizeMB is the size of the task's secrets directory. If zero
+	// the client's default size is used.
+	SecretsDirSizeMB int
+
 	// Artifacts is a list of artifacts to download and extract before running
 	// the task.
 	Artifacts []*TaskArtifact
@@ -2488,6 +2492,9 @@ func (t *Task) Validate(ephemeralDisk *EphemeralDisk) error {
 	if t.KillTimeout.Nanoseconds() < 0 {
 		mErr.Errors = append(mErr.Errors, errors.New("KillTimeout must be a positive value"))
 	}
+	if t.SecretsDirSizeMB < 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("SecretsDirSizeMB must be a positive value"))
+	}
 
 	// Validate the resources.
 	if t.Resources == nil {